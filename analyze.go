@@ -0,0 +1,80 @@
+package rsocks
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+)
+
+const maxSamples = 5
+
+// Report describes the format of a list as seen by the parser.
+type Report struct {
+	// Lines counts the lines left once comments and blank lines are dropped.
+	Lines, Parsed int
+	// Rejected counts the rejected lines by reason, "format" for lines
+	// without the expected fields and "url" for lines that don't make a
+	// valid URL. Samples holds a few of them per reason.
+	Rejected map[string]int
+	Samples  map[string][]string
+	// Schemes and Ports count the parsed proxies per scheme and port.
+	Schemes map[string]int
+	Ports   map[string]int
+}
+
+// Analyze downloads and parses the list without validating or caching it,
+// to check the format of a provider.
+func (c *client) Analyze(ctx context.Context) (Report, error) {
+	rp := Report{
+		Rejected: make(map[string]int),
+		Samples:  make(map[string][]string),
+		Schemes:  make(map[string]int),
+		Ports:    make(map[string]int),
+	}
+	if c.ctx.Err() != nil {
+		return rp, ErrClosed
+	}
+	ctx, cancel := c.context(ctx)
+	defer cancel()
+
+	c.proxiesMu.Lock()
+	listUrl := c.listUrl
+	c.proxiesMu.Unlock()
+	r, err := c.get(ctx, listUrl)
+	if err != nil {
+		return rp, err
+	}
+	defer r.Body.Close()
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return rp, err
+	}
+	if isHTML(r, b) {
+		return rp, ErrHTML
+	}
+
+	lines, err := c.entries(b, c.formatOf(r, b))
+	if err != nil {
+		return rp, err
+	}
+	for _, e := range lines {
+		rp.Lines++
+		var u *url.URL
+		_, u, err = c.parseProxyLine(e.line)
+		if err != nil {
+			reason := reasonFormat
+			if le, ok := err.(*lineError); ok {
+				reason = le.reason
+			}
+			rp.Rejected[reason]++
+			if len(rp.Samples[reason]) < maxSamples {
+				rp.Samples[reason] = append(rp.Samples[reason], e.line)
+			}
+			continue
+		}
+		rp.Parsed++
+		rp.Schemes[u.Scheme]++
+		rp.Ports[u.Port()]++
+	}
+	return rp, nil
+}
@@ -0,0 +1,129 @@
+package rsocks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Anonymity is how much a proxy reveals about its client.
+type Anonymity int
+
+const (
+	// AnonymityUnknown is the level of proxies DetectAnonymity didn't check.
+	AnonymityUnknown Anonymity = iota
+	// Transparent proxies forward the IP of their client.
+	Transparent
+	// Anonymous proxies hide the client IP but announce themselves.
+	Anonymous
+	// Elite proxies don't add any proxy header.
+	Elite
+)
+
+// proxyHeaders are the headers announcing a request went through a proxy.
+var proxyHeaders = []string{"Via", "Forwarded", "X-Forwarded-For", "X-Real-Ip", "X-Proxy-Id", "Proxy-Connection", "Client-Ip"}
+
+// DetectAnonymity requests echoUrl through the proxy u and classifies it by
+// the headers the endpoint received. echoUrl must answer with the request
+// headers as JSON, like https://httpbin.org/headers. The result is recorded
+// for proxies of the pool, see Anonymity.
+func (c *client) DetectAnonymity(ctx context.Context, u *url.URL, echoUrl string) (Anonymity, error) {
+	ctx, cancel := c.context(ctx)
+	defer cancel()
+	direct, err := c.cachedDirectIP(ctx)
+	if err != nil {
+		return AnonymityUnknown, err
+	}
+	req, err := http.NewRequest(http.MethodGet, echoUrl, nil)
+	if err != nil {
+		return AnonymityUnknown, err
+	}
+	r, err := c.validator(u).Do(req.WithContext(ctx))
+	if err != nil {
+		return AnonymityUnknown, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return AnonymityUnknown, fmt.Errorf("%s returned status %d", echoUrl, r.StatusCode)
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return AnonymityUnknown, err
+	}
+	var echo struct {
+		Headers map[string]string `json:"headers"`
+	}
+	if err = json.Unmarshal(b, &echo); err != nil {
+		return AnonymityUnknown, fmt.Errorf("could not decode the headers echoed by %s: %w", echoUrl, err)
+	}
+	level := classify(echo.Headers, direct)
+
+	c.proxiesMu.Lock()
+	s := u.String()
+	for ip, pu := range c.proxies {
+		if pu.String() == s {
+			c.meta(ip).anonymity = level
+		}
+	}
+	c.proxiesMu.Unlock()
+	return level, nil
+}
+
+// classify returns the anonymity of a proxy that delivered headers, given
+// the IP of its client.
+func classify(headers map[string]string, clientIp string) Anonymity {
+	seen := make(map[string]string, len(headers))
+	for k, v := range headers {
+		seen[http.CanonicalHeaderKey(k)] = v
+	}
+	level := Elite
+	for _, k := range proxyHeaders {
+		v, ok := seen[k]
+		if !ok {
+			continue
+		}
+		if clientIp != "" && strings.Contains(v, clientIp) {
+			return Transparent
+		}
+		level = Anonymous
+	}
+	return level
+}
+
+// Anonymity returns the level DetectAnonymity found for the proxy stored
+// under ip.
+func (c *client) Anonymity(ip string) Anonymity {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	if m, ok := c.metas[ip]; ok {
+		return m.anonymity
+	}
+	return AnonymityUnknown
+}
+
+// EliteProxies returns the proxies DetectAnonymity classified as Elite.
+func (c *client) EliteProxies() []Proxy {
+	return c.proxiesAt(Elite)
+}
+
+// AnonymousProxies returns the proxies DetectAnonymity classified as
+// Anonymous.
+func (c *client) AnonymousProxies() []Proxy {
+	return c.proxiesAt(Anonymous)
+}
+
+func (c *client) proxiesAt(level Anonymity) []Proxy {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	var l []Proxy
+	for _, ip := range c.keys() {
+		if m, ok := c.metas[ip]; ok && m.anonymity == level {
+			l = append(l, c.record(ip, c.proxies[ip]))
+		}
+	}
+	return l
+}
@@ -0,0 +1,130 @@
+package rsocks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gadelkareem/cachita"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrCacheCorrupt matches, with errors.Is, the errors of cached lists that
+// can't be decoded. InvalidateCache drops them so the next List() downloads
+// the list again.
+var ErrCacheCorrupt = errors.New("rsocks: cached list is corrupt")
+
+// CacheError is a failure reading the cached list entry Key. Err is the
+// error of the cache.
+type CacheError struct {
+	Key     string
+	Err     error
+	corrupt bool
+}
+
+func (e *CacheError) Error() string {
+	return fmt.Sprintf("%s reading cache entry %s", e.Err, e.Key)
+}
+
+func (e *CacheError) Unwrap() error {
+	return e.Err
+}
+
+func (e *CacheError) Is(target error) bool {
+	return target == ErrCacheCorrupt && e.corrupt
+}
+
+// cacheError wraps the error of reading k, telling decoding failures apart
+// from those of the cache backend.
+func cacheError(k string, err error) error {
+	// the file cache decodes with msgpack, whose errors are plain strings
+	corrupt := err == io.ErrUnexpectedEOF || strings.HasPrefix(err.Error(), "msgpack:")
+	return &CacheError{Key: k, Err: err, corrupt: corrupt}
+}
+
+// InvalidateCache drops the cached copy of the list at listUrl, but not the
+// one kept for ServeStaleOnError.
+func (c *client) InvalidateCache(listUrl string) error {
+	k := c.CacheKey(listUrl)
+	var shards int
+	c.listCache.Get(k+"_shards", &shards)
+	keys := []string{k, k + "_order", k + "_fetched", k + "_shards", k + "_meta", k + "_ttl"}
+	for i := 0; i < shards; i++ {
+		keys = append(keys, fmt.Sprintf("%s_shard_%d", k, i))
+	}
+	for _, key := range keys {
+		if err := c.listCache.Invalidate(key); err != nil && err != cachita.ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetCacheCodec sets how the records of cached proxies, their latency,
+// health, country and tags, are encoded so a restart doesn't lose them.
+// They are JSON by default.
+func (c *client) SetCacheCodec(encode func(v interface{}) ([]byte, error), decode func(b []byte, v interface{}) error) {
+	c.encode, c.decode = encode, decode
+}
+
+// putMeta caches the records of proxies under k.
+func (c *client) putMeta(k string, proxies map[string]*url.URL, ttl time.Duration) error {
+	c.proxiesMu.Lock()
+	l := make([]proxyState, 0, len(proxies))
+	for ip, u := range proxies {
+		ps := proxyState{IP: ip, Tags: c.tags[u.Host]}
+		if m, ok := c.metas[ip]; ok {
+			ps.Latency, ps.Attempts, ps.Successes = m.latency, m.attempts, m.successes
+			ps.Dead, ps.Validated = m.dead, m.validated
+			ps.Country, ps.Weight = m.country, m.score
+		}
+		l = append(l, ps)
+	}
+	c.proxiesMu.Unlock()
+
+	encode := c.encode
+	if encode == nil {
+		encode = json.Marshal
+	}
+	b, err := encode(l)
+	if err != nil {
+		return fmt.Errorf("%s encoding cache entry %s", err, k)
+	}
+	return c.listCache.Put(k, &b, ttl)
+}
+
+// restoreMeta restores the records cached under k of the proxies loaded
+// from the cache. proxiesMu must be held.
+func (c *client) restoreMeta(k string, proxies map[string]*url.URL) {
+	var b []byte
+	if err := c.listCache.Get(k, &b); err != nil || len(b) == 0 {
+		return
+	}
+	decode := c.decode
+	if decode == nil {
+		decode = json.Unmarshal
+	}
+	var l []proxyState
+	if err := decode(b, &l); err != nil {
+		// the records are a nicety, the list is still good without them
+		return
+	}
+	for _, ps := range l {
+		u, ok := proxies[ps.IP]
+		if !ok {
+			continue
+		}
+		m := c.meta(ps.IP)
+		m.attempts, m.successes = ps.Attempts, ps.Successes
+		m.dead, m.validated = ps.Dead, ps.Validated
+		m.latency, m.country, m.score = ps.Latency, ps.Country, ps.Weight
+		if c.tags == nil {
+			c.tags = make(map[string][]string)
+		}
+		if _, ok := c.tags[u.Host]; !ok && len(ps.Tags) > 0 {
+			c.tags[u.Host] = ps.Tags
+		}
+	}
+}
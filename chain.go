@@ -0,0 +1,103 @@
+package rsocks
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ValidateProxyVia requests the check URL through upstream and then proxy and
+// returns the exit IP of the chain. upstream must be an HTTP or HTTPS proxy
+// that supports CONNECT, HTTPS using the validation TLS config; proxy may be
+// any scheme the validator supports.
+func (c *client) ValidateProxyVia(ctx context.Context, proxy, upstream *url.URL) (string, error) {
+	if upstream.Scheme != "http" && upstream.Scheme != "https" {
+		return "", fmt.Errorf("unsupported upstream scheme %s", upstream.Scheme)
+	}
+	ctx, cancel := c.context(ctx)
+	defer cancel()
+
+	transport := &http.Transport{
+		Proxy:           http.ProxyURL(proxy),
+		TLSClientConfig: c.tlsConfig,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialVia(ctx, c.resolver, c.tlsConfig, upstream, addr)
+		},
+	}
+	defer transport.CloseIdleConnections()
+	return c.checkIp(ctx, &http.Client{Transport: transport, Timeout: 60 * time.Second}, true)
+}
+
+// dialVia opens a tunnel to addr through the HTTP proxy upstream, resolving
+// upstream with r. An https upstream is spoken to over TLS configured by cfg.
+func dialVia(ctx context.Context, r *net.Resolver, cfg *tls.Config, upstream *url.URL, addr string) (net.Conn, error) {
+	d := net.Dialer{Resolver: r}
+	conn, err := d.DialContext(ctx, "tcp", upstream.Host)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if upstream.Scheme == "https" {
+		if cfg == nil {
+			cfg = &tls.Config{}
+		} else {
+			cfg = cfg.Clone()
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = upstream.Hostname()
+		}
+		tc := tls.Client(conn, cfg)
+		if err = tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := upstream.User; u != nil {
+		p, _ := u.Password()
+		req.SetBasicAuth(u.Username(), p)
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		req.Header.Del("Authorization")
+	}
+	if err = req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("upstream %s refused CONNECT %s: %s", upstream.Host, addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return &bufferedConn{conn, br}, nil
+}
+
+// bufferedConn reads what the CONNECT response reader buffered first.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
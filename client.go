@@ -3,101 +3,1304 @@ package rsocks
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"github.com/cenkalti/backoff"
 	"github.com/gadelkareem/cachita"
 	h "github.com/gadelkareem/go-helpers"
 	"github.com/gadelkareem/quiver"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	Version   = "v1"
 	userAgent = "rsocks_client/" + Version + " " + runtime.GOOS + " " + runtime.GOARCH
+
+	checkUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/58.0.3029.81 Safari/537.36"
+
+	closeTimeout     = 30 * time.Second
+	progressInterval = 500 * time.Millisecond
+	defaultCheck     = "http://ifconfig.io/ip"
+	defaultScheme    = "http"
+	defaultComment   = "#"
+	defaultName      = "rsocks"
+	staleTtl         = 7 * 24 * time.Hour
 )
 
-type client struct {
-	*http.Client
-	listUrl   string
-	listCache cachita.Cache
-	proxiesMu sync.Mutex
-	proxies   map[string]*url.URL
+// ParseErrors holds the lines List() failed to parse in strict mode.
+type ParseErrors []error
+
+func (e ParseErrors) Error() string {
+	const shown = 10
+	var msgs []string
+	for i, err := range e {
+		if i == shown {
+			msgs = append(msgs, fmt.Sprintf("and %d more", len(e)-shown))
+			break
+		}
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+var (
+	ErrClosed    = errors.New("rsocks: client is closed")
+	ErrNoProxies = errors.New("rsocks: no proxies found")
+	ErrHTML      = errors.New("rsocks: list endpoint returned an HTML page")
+)
+
+type client struct {
+	*http.Client
+	listUrl      string
+	listCache    cachita.Cache
+	proxiesMu    sync.Mutex
+	proxies      map[string]*url.URL
+	ctx          context.Context
+	cancel       context.CancelFunc
+	workers      sync.WaitGroup
+	scheme       string
+	portSchemes  map[int]string
+	comment      string
+	validate     bool
+	maxProxies   int
+	checkUrls    []string
+	checkNext    uint32
+	tlsConfig    *tls.Config
+	tags         map[string][]string
+	nonEmpty     bool
+	fallbackUrl  string
+	metas        map[string]*proxyMeta
+	sampleRate   float64
+	onValidated  func(ip string, u *url.URL)
+	rejectDirect bool
+	directIp     string
+	validatorsMu sync.Mutex
+	validators   map[string]*http.Client
+	lastFetch    time.Time
+	fromCache    bool
+	strict       bool
+	next         int
+	sessionTmpl  string
+	sessions     map[string]string
+	blocklist    []*net.IPNet
+	shuffle      bool
+	duplicates   DuplicatePolicy
+	check        checkRequest
+	extractIp    func(body []byte) (string, error)
+	onProgress   func(done, total int)
+	maxLatency   time.Duration
+	retry        RetryStrategy
+	noRetry      bool
+	format       Format
+	csvColumns   CSVColumns
+	serveStale   bool
+	listing      *listCall
+	order        map[string]int
+	liftRLimits  bool
+	budget       time.Duration
+	sources      []source
+	resolver     *net.Resolver
+	deadCooldown time.Duration
+	shardSize    int
+	reachOnly    bool
+	certPins     map[string]bool
+	name         string
+	events       events
+	quarantine   bool
+	quarantined  map[string]*url.URL
+	headers      http.Header
+	onRemoved    func(ip string)
+	lazy         bool
+	transform    func(line string) string
+	connsMu      sync.Mutex
+	maxConns     int
+	connsBlock   bool
+	conns        map[string]int
+	connFreed    chan struct{}
+	transports   map[string]*http.Transport
+	revalMu      sync.Mutex
+	stopReval    context.CancelFunc
+	revalDone    chan struct{}
+	weightColumn bool
+	geoLookup    func(ip string) string
+	countries    map[string]bool
+	revalTtl     time.Duration
+	keyFunc      func(ip string, u *url.URL) string
+	checkOk      func(status int, body []byte) bool
+	static       []byte
+	collapse     bool
+	collapsed    int
+	onFailed     func(ip string, u *url.URL, reason string, err error)
+	failures     map[string]int
+	revalAfter   time.Duration
+	leases       map[string]*Lease
+	leaseTimeout time.Duration
+	userAgents   []string
+	uaNext       uint32
+	encode       func(v interface{}) ([]byte, error)
+	decode       func(b []byte, v interface{}) error
+	hostsMu      sync.Mutex
+	perHost      int
+	hostSlots    map[string]chan struct{}
+}
+
+type checkRequest struct {
+	method, contentType string
+	body                []byte
+	status              int
+}
+
+func NewClient(listUrl string, cl *http.Client) (c *client, err error) {
+	if cl == nil {
+		cl = http.DefaultClient
+	}
+
+	f, err := cachita.NewFileCache("/tmp/rsocks", 24*time.Hour, 1*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &client{
+		Client:      cl,
+		listUrl:     listUrl,
+		listCache:   f,
+		proxies:     make(map[string]*url.URL),
+		metas:       make(map[string]*proxyMeta),
+		validators:  make(map[string]*http.Client),
+		sessions:    make(map[string]string),
+		order:       make(map[string]int),
+		quarantined: make(map[string]*url.URL),
+		conns:       make(map[string]int),
+		connFreed:   make(chan struct{}),
+		transports:  make(map[string]*http.Transport),
+		failures:    make(map[string]int),
+		leases:      make(map[string]*Lease),
+		ctx:         ctx,
+		cancel:      cancel,
+		scheme:      defaultScheme,
+		comment:     defaultComment,
+		checkUrls:   []string{defaultCheck},
+		sampleRate:  1,
+		check:       checkRequest{method: http.MethodGet, status: http.StatusOK},
+		retry:       NewExponentialRetry(),
+		csvColumns:  DefaultCSVColumns,
+		name:        defaultName,
+		events:      events{size: defaultEventBuffer},
+	}, nil
+}
+
+// NewStaticClient returns a client whose pool is proxies, parsed as the
+// lines of a list, rather than a downloaded list. List() parses them again
+// whenever the pool is empty; ValidateAll checks them.
+func NewStaticClient(proxies []string, cl *http.Client) (c *client, err error) {
+	c, err = NewClient("", cl)
+	if err != nil {
+		return nil, err
+	}
+	c.static = []byte(strings.Join(proxies, "\n"))
+	if _, err = c.List(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// SetHTTPClient replaces the client lists are downloaded with. Downloads in
+// progress finish with the previous one. nil uses http.DefaultClient.
+func (c *client) SetHTTPClient(cl *http.Client) {
+	if cl == nil {
+		cl = http.DefaultClient
+	}
+	c.proxiesMu.Lock()
+	c.Client = cl
+	c.proxiesMu.Unlock()
+	// validation inherits the transport settings
+	c.dropValidators(nil)
+}
+
+// SetListHeader sets a header sent with list downloads, e.g. Accept to
+// negotiate the format or Authorization. An empty value removes it.
+func (c *client) SetListHeader(key, value string) {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	if c.headers == nil {
+		c.headers = make(http.Header)
+	}
+	if value == "" {
+		c.headers.Del(key)
+		return
+	}
+	c.headers.Set(key, value)
+}
+
+func (c *client) listHeaders() http.Header {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	return c.headers.Clone()
+}
+
+func (c *client) httpClient() *http.Client {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	return c.Client
+}
+
+// SetScheme sets the scheme used for lines that don't carry one, e.g. "socks5".
+func (c *client) SetScheme(scheme string) {
+	c.scheme = scheme
+}
+
+// SetValidate makes List() check every proxy through the IP echo endpoint and
+// key the live ones by their exit IP.
+func (c *client) SetValidate(v bool) {
+	c.validate = v
+}
+
+// SetValidationSampleRate validates each proxy with probability p when
+// validation is enabled. The others are kept, keyed by their endpoint, and
+// reported by Validated as unchecked.
+func (c *client) SetValidationSampleRate(p float64) {
+	c.sampleRate = p
+}
+
+// OnProxyValidated registers fn to be called from the List() workers as each
+// proxy passes validation, before the list is cached.
+func (c *client) OnProxyValidated(fn func(ip string, u *url.URL)) {
+	c.onValidated = fn
+}
+
+// SetRejectDirectIP makes validation drop proxies whose exit IP is the
+// client's own, looked up once through the check endpoint without a proxy.
+func (c *client) SetRejectDirectIP(v bool) {
+	c.rejectDirect = v
+}
+
+// OnValidationProgress registers fn to be called every progressInterval
+// while List() processes the list, and once when it is done, with the
+// number of lines processed and the number of lines in the list.
+func (c *client) OnValidationProgress(fn func(done, total int)) {
+	c.onProgress = fn
+}
+
+// SetCheckURL sets the endpoint used to validate proxies. It must respond with
+// the caller's IP as plain text.
+func (c *client) SetCheckURL(u string) {
+	c.checkUrls = []string{u}
+}
+
+// SetCheckURLs spreads validation across several check endpoints: each check
+// starts at the next one in turn and tries the others when it fails.
+func (c *client) SetCheckURLs(urls ...string) {
+	c.checkUrls = append([]string(nil), urls...)
+}
+
+// SetReachabilityOnly makes validation send HEAD requests to the check URL
+// and accept proxies it answers with 2xx through, without looking up their
+// exit IP. Proxies then stay keyed by their endpoint and the direct IP,
+// blocklist and IP extractor settings don't apply.
+func (c *client) SetReachabilityOnly(v bool) {
+	c.reachOnly = v
+}
+
+// SetCheckRequest sets the method, body and its content type of validation
+// requests, and the status the check endpoint answers live proxies with.
+func (c *client) SetCheckRequest(method, contentType string, body []byte, wantStatus int) {
+	c.check = checkRequest{method: method, contentType: contentType, body: body, status: wantStatus}
+}
+
+// SetUserAgentPool makes validation and prewarm requests rotate through
+// agents as their User-Agent rather than sending a single Chrome one.
+func (c *client) SetUserAgentPool(agents []string) {
+	c.userAgents = append([]string(nil), agents...)
+}
+
+// userAgent returns the User-Agent of the next check request.
+func (c *client) userAgent() string {
+	if len(c.userAgents) == 0 {
+		return checkUserAgent
+	}
+	return c.userAgents[int(atomic.AddUint32(&c.uaNext, 1)-1)%len(c.userAgents)]
+}
+
+// SetValidationSuccessFunc sets fn to decide from the status and body of
+// the check response whether a proxy is alive, in place of wanting the
+// status of SetCheckRequest and an IP body. The exit IP set by
+// SetIPExtractor keys the proxies it finds one for, the others keep their
+// list key. Answers of 400 and above still fail the check.
+func (c *client) SetValidationSuccessFunc(fn func(status int, body []byte) bool) {
+	c.checkOk = fn
+}
+
+// SetIPExtractor sets how the exit IP is read from the check endpoint
+// response, for endpoints that don't answer with the bare IP.
+func (c *client) SetIPExtractor(fn func(body []byte) (string, error)) {
+	c.extractIp = fn
+}
+
+// SetValidationTLSConfig sets the TLS config used when validating against an
+// HTTPS check endpoint, e.g. to pin its certificate and catch intercepting
+// proxies. nil uses the system roots.
+func (c *client) SetValidationTLSConfig(cfg *tls.Config) {
+	c.tlsConfig = cfg
+	c.dropValidators(nil)
+}
+
+// SetValidationResolver sets the resolver validation uses to look up proxy
+// and check endpoint hostnames. The addresses it returns are still dialed
+// by the transport lists are downloaded with. nil uses the system resolver.
+func (c *client) SetValidationResolver(r *net.Resolver) {
+	c.resolver = r
+	c.dropValidators(nil)
+}
+
+// SetMaxValidationsPerHost caps the validations running at once through
+// proxies sharing a host:port, e.g. the gateway of a provider. Zero, the
+// default, doesn't cap them.
+func (c *client) SetMaxValidationsPerHost(n int) {
+	c.hostsMu.Lock()
+	defer c.hostsMu.Unlock()
+	c.perHost = n
+	c.hostSlots = make(map[string]chan struct{})
+}
+
+// acquireHost waits for a validation slot of host and returns the func
+// giving it back.
+func (c *client) acquireHost(ctx context.Context, host string) (release func(), err error) {
+	c.hostsMu.Lock()
+	if c.perHost <= 0 {
+		c.hostsMu.Unlock()
+		return func() {}, nil
+	}
+	slots, ok := c.hostSlots[host]
+	if !ok {
+		slots = make(chan struct{}, c.perHost)
+		c.hostSlots[host] = slots
+	}
+	c.hostsMu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// SetLazyValidation makes List() skip validation and RandomProxy and
+// NextProxy validate each proxy the first time they pick it instead, picking
+// another one when it fails. Results are kept, so each proxy is checked once.
+// Lazily validated proxies stay keyed by their endpoint. It needs
+// SetValidate(true).
+func (c *client) SetLazyValidation(v bool) {
+	c.lazy = v
+}
+
+// SetShuffle makes List() validate the lines in random order rather than
+// file order, so an early stop or early selection sees a sample of the
+// whole list.
+func (c *client) SetShuffle(v bool) {
+	c.shuffle = v
+}
+
+// SetLiftRLimits makes List() raise the open files limit before validating
+// the list. Failing to do so is logged and List() goes on with the current
+// limit. Off by default as restricted hosts may forbid it.
+func (c *client) SetLiftRLimits(v bool) {
+	c.liftRLimits = v
+}
+
+// SetValidationBudget bounds the time List() spends validating the list.
+// Checks still running when d elapses are cancelled and the pool is what
+// passed so far. Zero, the default, waits for every check.
+func (c *client) SetValidationBudget(d time.Duration) {
+	c.budget = d
+}
+
+// SetMaxLatency makes validation fail for proxies that can't complete the
+// check within d. 0 keeps the 60s validation timeout.
+func (c *client) SetMaxLatency(d time.Duration) {
+	c.maxLatency = d
+}
+
+// SetMaxProxies stops List() once n proxies are in the pool, cancelling the
+// remaining workers. 0 means no limit.
+func (c *client) SetMaxProxies(n int) {
+	c.maxProxies = n
+}
+
+// SetStrict makes List() fail with ParseErrors when any line can't be parsed
+// instead of logging and skipping it.
+func (c *client) SetStrict(v bool) {
+	c.strict = v
+}
+
+// SetRequireNonEmpty makes List() return ErrNoProxies instead of an empty
+// pool when the list yields no proxies.
+func (c *client) SetRequireNonEmpty(v bool) {
+	c.nonEmpty = v
+}
+
+// SetRetryStrategy sets how list downloads are retried. nil restores the
+// default ExponentialRetry.
+func (c *client) SetRetryStrategy(s RetryStrategy) {
+	if s == nil {
+		s = NewExponentialRetry()
+	}
+	c.retry = s
+}
+
+// SetNoRetry makes list downloads and validation checks a single attempt:
+// a failed download isn't retried, whatever SetRetryStrategy set, and a
+// failed check doesn't move on to the next of SetCheckURLs. The fallback
+// URL and ServeStaleOnError still apply.
+func (c *client) SetNoRetry(v bool) {
+	c.noRetry = v
+}
+
+// SetFallbackURL sets a mirror List() loads from when the list URL fails.
+func (c *client) SetFallbackURL(u string) {
+	c.fallbackUrl = u
+}
+
+// ServeStaleOnError makes List() fall back to the last downloaded pool, even
+// an expired one, when loading the list fails. LastFetch reports its age.
+func (c *client) ServeStaleOnError(b bool) {
+	c.serveStale = b
+}
+
+// SetCacheShardSize splits cached lists larger than n bytes of keys and URLs
+// across several cache entries of about n bytes each, for cache backends
+// that limit value sizes. Zero, the default, keeps one entry per list.
+func (c *client) SetCacheShardSize(n int) {
+	c.shardSize = n
+}
+
+// SetLineTransform sets fn to rewrite each list line before it's parsed,
+// after comments are stripped, e.g. to drop provider junk. Lines fn returns
+// empty are skipped. For CSV and TSV lists fn gets the host:port[:user:pass]
+// line built from the row. The cached lists of clients with a transform are
+// kept apart from those without one, but not from clients with another
+// transform: call InvalidateCache after changing it.
+func (c *client) SetLineTransform(fn func(line string) string) {
+	c.transform = fn
+}
+
+// SetWeightColumn reads a trailing numeric column of list lines, as in
+// host:port:weight or host:port:user:pass:weight, as a provider score that
+// scales the weight of the proxy in WeightedProxy and SampleProxies.
+func (c *client) SetWeightColumn(v bool) {
+	c.weightColumn = v
+}
+
+// SetCollapseEndpoints makes List() keep one proxy per host:port, the first
+// to pass validation or the first listed without it, dropping the others
+// listed with other credentials. Stats().Collapsed counts them.
+func (c *client) SetCollapseEndpoints(v bool) {
+	c.collapse = v
+}
+
+// collapsedEndpoint reports whether a proxy at host is dropped by
+// SetCollapseEndpoints, claiming host for the proxy if claim is set.
+func (c *client) collapsedEndpoint(endpoints map[string]bool, host string, claim bool) bool {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	if endpoints[host] {
+		c.collapsed++
+		return true
+	}
+	if claim {
+		endpoints[host] = true
+	}
+	return false
+}
+
+// SetKeyFunc sets fn to compute the pool key of each proxy List() keeps
+// from ip, its exit IP when validated and its URL otherwise, and u. Proxies
+// sharing a key are duplicates, see SetDuplicatePolicy. The cached lists of
+// clients with a key function are kept apart from those without one, but
+// not from clients with another function: call InvalidateCache after
+// changing it.
+func (c *client) SetKeyFunc(fn func(ip string, u *url.URL) string) {
+	c.keyFunc = fn
+}
+
+// SetComment sets the marker after which the rest of a list line is ignored.
+// An empty marker disables comment stripping.
+func (c *client) SetComment(comment string) {
+	c.comment = comment
+}
+
+// SetPortSchemeMap picks the scheme of lines without an explicit scheme by
+// their port, e.g. {1080: "socks5", 3128: "http"}. Ports missing from m use
+// the client scheme.
+func (c *client) SetPortSchemeMap(m map[int]string) {
+	c.portSchemes = make(map[int]string, len(m))
+	for p, s := range m {
+		c.portSchemes[p] = s
+	}
+}
+
+// Close cancels any running List() and waits up to closeTimeout for its
+// workers to return. The client can't be used after Close.
+func (c *client) Close() error {
+	c.cancel()
+	defer c.dropValidators(nil)
+	defer c.closeEvents()
+	defer c.closeTransports()
+
+	done := make(chan struct{})
+	go func() {
+		c.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(closeTimeout):
+		return fmt.Errorf("timed out after %s waiting for workers", closeTimeout)
+	}
+}
+
+func (c *client) List() (map[string]*url.URL, error) {
+	if c.ctx.Err() != nil {
+		return nil, ErrClosed
+	}
+	c.workers.Add(1)
+	defer c.workers.Done()
+
+	c.proxiesMu.Lock()
+	// callers arriving while the pool loads share that load
+	if call := c.listing; call != nil {
+		c.proxiesMu.Unlock()
+		<-call.done
+		return call.proxies, call.err
+	}
+	listUrl, proxies := c.listUrl, c.proxies
+	if len(proxies) > 0 {
+		defer c.proxiesMu.Unlock()
+		return proxies, nil
+	}
+	call := &listCall{done: make(chan struct{})}
+	c.listing = call
+	c.proxiesMu.Unlock()
+
+	call.proxies, call.err = c.list(listUrl, proxies)
+	c.proxiesMu.Lock()
+	c.listing = nil
+	c.proxiesMu.Unlock()
+	close(call.done)
+	return call.proxies, call.err
+}
+
+// listCall is a List() load in progress.
+type listCall struct {
+	done    chan struct{}
+	proxies map[string]*url.URL
+	err     error
+}
+
+func (c *client) list(listUrl string, proxies map[string]*url.URL) (map[string]*url.URL, error) {
+	c.proxiesMu.Lock()
+	c.collapsed = 0
+	c.proxiesMu.Unlock()
+	var err error
+	if c.static != nil {
+		err = c.loadStatic(proxies)
+	} else {
+		// proxies are added to the pool as they are validated
+		err = c.load(c.ctx, listUrl, false, false, proxies, c.order)
+	}
+	if _, bad := err.(ParseErrors); err != nil && !bad && err != ErrClosed && c.ctx.Err() == nil && c.fallbackUrl != "" {
+		c.clear(proxies)
+		fmt.Fprintf(os.Stderr, "%s loading %s, trying fallback %s\n", err, listUrl, c.fallbackUrl)
+		err = c.load(c.ctx, c.fallbackUrl, false, false, proxies, c.order)
+	}
+	if _, bad := err.(ParseErrors); err != nil && !bad && err != ErrClosed && c.ctx.Err() == nil && c.serveStale {
+		c.clear(proxies)
+		if c.loadStale(c.CacheKey(listUrl), proxies) {
+			fmt.Fprintf(os.Stderr, "%s loading %s, serving the pool fetched at %s\n", err, listUrl, c.lastFetch)
+			err = nil
+		}
+	}
+	if err != nil {
+		// the pool was empty, drop what failed loads added
+		c.clear(proxies)
+		return nil, err
+	}
+	c.loadSources(proxies, c.order, false)
+
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	// forgets the clients of proxies that failed validation
+	c.dropValidators(c.proxies)
+	return c.proxies, nil
+}
+
+// loadStatic adds the proxies of NewStaticClient to proxies.
+func (c *client) loadStatic(proxies map[string]*url.URL) error {
+	c.proxiesMu.Lock()
+	c.lastFetch, c.fromCache = time.Now(), false
+	c.proxiesMu.Unlock()
+	return c.parse(c.ctx, c.static, c.formatOf(nil, c.static), false, proxies, c.order)
+}
+
+func (c *client) clear(proxies map[string]*url.URL) {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	for ip := range proxies {
+		delete(proxies, ip)
+	}
+}
+
+// WaitForProxies runs List() in the background and returns once n proxies
+// not marked dead are in the pool, List() fails or ctx is done. List() keeps
+// filling the pool after it returns.
+func (c *client) WaitForProxies(ctx context.Context, n int) error {
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.List()
+		errc <- err
+	}()
+
+	t := time.NewTicker(100 * time.Millisecond)
+	defer t.Stop()
+	for {
+		if c.Stats().Live >= n {
+			return nil
+		}
+		select {
+		case err := <-errc:
+			if err != nil {
+				return err
+			}
+			if live := c.Stats().Live; live < n {
+				return fmt.Errorf("list yielded %d live proxies, want %d", live, n)
+			}
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// LastFetch returns when the list of the pool was downloaded and whether the
+// pool was loaded from the cache rather than that download. The time is zero
+// when it isn't known, e.g. for entries cached by older versions.
+func (c *client) LastFetch() (time.Time, bool) {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	return c.lastFetch, c.fromCache
+}
+
+// SetListURL switches the client to another list. The current pool is
+// dropped so the next List() loads the new one; use SwapSource to switch
+// without an empty pool in between.
+func (c *client) SetListURL(u string) {
+	c.proxiesMu.Lock()
+	old := c.proxies
+	c.listUrl = u
+	c.proxies = make(map[string]*url.URL)
+	c.metas = make(map[string]*proxyMeta)
+	c.order = make(map[string]int)
+	c.quarantined = make(map[string]*url.URL)
+	c.dropValidators(nil)
+	c.proxiesMu.Unlock()
+	c.removed(old)
+}
+
+// SwapSource downloads the list at u and, only if it yields at least
+// minProxies proxies, makes it the client list and, merged with the lists
+// added with AddListURL, the pool in one step.
+// Otherwise the current list and pool are kept.
+func (c *client) SwapSource(ctx context.Context, u string, minProxies int) error {
+	if c.ctx.Err() != nil {
+		return ErrClosed
+	}
+	c.workers.Add(1)
+	defer c.workers.Done()
+
+	ctx, cancel := c.context(ctx)
+	defer cancel()
+	// the candidate stays off the pool and its order until it's accepted
+	l, order := make(map[string]*url.URL), make(map[string]int)
+	err := c.load(ctx, u, true, true, l, order)
+	if err != nil {
+		return err
+	}
+	if len(l) < minProxies {
+		return fmt.Errorf("%s yielded %d proxies, want at least %d", u, len(l), minProxies)
+	}
+	c.loadSources(l, order, true)
+	c.swap(u, l, order, true)
+	return nil
+}
+
+// ProxiesFresh downloads the list again, bypassing the cache, and makes it,
+// merged with the lists added with AddListURL, the pool. List() keeps
+// serving the cached pool otherwise.
+func (c *client) ProxiesFresh(ctx context.Context) (map[string]*url.URL, error) {
+	if c.ctx.Err() != nil {
+		return nil, ErrClosed
+	}
+	c.workers.Add(1)
+	defer c.workers.Done()
+
+	ctx, cancel := c.context(ctx)
+	defer cancel()
+	c.proxiesMu.Lock()
+	u := c.listUrl
+	c.proxiesMu.Unlock()
+	l := make(map[string]*url.URL)
+	var err error
+	if c.static != nil {
+		err = c.loadStatic(l)
+	} else {
+		err = c.load(ctx, u, true, false, l, c.order)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.loadSources(l, c.order, false)
+	c.swap(u, l, c.order, false)
+	return l, nil
+}
+
+// swap makes l, loaded from u, the list and pool and order the positions of
+// its proxies. announce reports the proxies of l as added, for pools loaded
+// quietly.
+func (c *client) swap(u string, l map[string]*url.URL, order map[string]int, announce bool) {
+	c.proxiesMu.Lock()
+	gone := make(map[string]*url.URL)
+	for ip, pu := range c.proxies {
+		if _, ok := l[ip]; !ok {
+			gone[ip] = pu
+		}
+	}
+	c.listUrl = u
+	c.proxies = l
+	c.order = order
+	var validated map[string]*url.URL
+	if announce && c.onValidated != nil {
+		validated = make(map[string]*url.URL)
+		for ip, pu := range l {
+			if m, ok := c.metas[ip]; ok && m.validated {
+				validated[ip] = pu
+			}
+		}
+	}
+	c.proxiesMu.Unlock()
+	c.dropValidators(l)
+	c.removed(gone)
+	if announce {
+		c.added(l)
+		for ip, pu := range validated {
+			c.onValidated(ip, pu)
+		}
+	}
+}
+
+// context returns a child of parent that is also cancelled by Close.
+func (c *client) context(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	go func() {
+		select {
+		case <-c.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// CacheKey returns the key the list downloaded from listUrl is cached under.
+// Clients parsing lists differently, e.g. with another scheme or format, or
+// keeping other proxies of them, e.g. validating or capping the pool, use
+// different keys.
+func (c *client) CacheKey(listUrl string) string {
+	k := fmt.Sprintf("list_%s", listUrl)
+	if opts := c.parseOptions(); opts != defaultParseOptions {
+		f := fnv.New64a()
+		io.WriteString(f, opts)
+		k += fmt.Sprintf("_%x", f.Sum64())
+	}
+	return k
+}
+
+// defaultParseOptions is parseOptions of a new client, whose lists keep the
+// key of versions that didn't tell options apart.
+var defaultParseOptions = (&client{scheme: defaultScheme, comment: defaultComment, csvColumns: DefaultCSVColumns}).parseOptions()
+
+// parseOptions describes the settings that change the proxies parsed from a
+// list and kept in the pool.
+func (c *client) parseOptions() string {
+	ports := make([]int, 0, len(c.portSchemes))
+	for p := range c.portSchemes {
+		ports = append(ports, p)
+	}
+	sort.Ints(ports)
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s|%q|%d|%+v", c.scheme, c.comment, c.format, c.csvColumns)
+	if c.weightColumn {
+		b.WriteString("|weight")
+	}
+	if c.keyFunc != nil {
+		b.WriteString("|keyfunc")
+	}
+	if c.transform != nil {
+		b.WriteString("|transform")
+	}
+	for _, p := range ports {
+		fmt.Fprintf(&b, "|%d=%s", p, c.portSchemes[p])
+	}
+	// the settings that drop proxies from the pool, so a pool cached
+	// unchecked or cut short isn't served to a client wanting more
+	if c.validate && !c.lazy {
+		fmt.Fprintf(&b, "|validate=%g,%t,%s,%s,%t", c.sampleRate, c.reachOnly, c.budget, c.maxLatency, c.rejectDirect)
+		for _, n := range c.blocklist {
+			fmt.Fprintf(&b, ",%s", n)
+		}
+	}
+	if c.maxProxies > 0 {
+		fmt.Fprintf(&b, "|max=%d", c.maxProxies)
+	}
+	if c.collapse {
+		b.WriteString("|collapse")
+	}
+	if len(c.countries) > 0 {
+		countries := make([]string, 0, len(c.countries))
+		for cc := range c.countries {
+			countries = append(countries, cc)
+		}
+		sort.Strings(countries)
+		fmt.Fprintf(&b, "|countries=%s", strings.Join(countries, ","))
+	}
+	return b.String()
+}
+
+// CacheKeys returns the cache keys of the list URL, the fallback URL and the
+// lists added with AddListURL.
+func (c *client) CacheKeys() []string {
+	c.proxiesMu.Lock()
+	listUrl := c.listUrl
+	sources := append([]source(nil), c.sources...)
+	c.proxiesMu.Unlock()
+	keys := []string{c.CacheKey(listUrl)}
+	if c.fallbackUrl != "" {
+		keys = append(keys, c.CacheKey(c.fallbackUrl))
+	}
+	for _, src := range sources {
+		// adding the list URL only sets its ttl
+		if src.url != listUrl && src.url != c.fallbackUrl {
+			keys = append(keys, c.CacheKey(src.url))
+		}
+	}
+	return keys
+}
+
+// load adds the proxies of the list at listUrl to proxies and their
+// positions in the list to order, from the cache unless fresh is set. Both
+// are written under proxiesMu.
+func (c *client) load(ctx context.Context, listUrl string, fresh, quiet bool, proxies map[string]*url.URL, order map[string]int) (err error) {
+	k := c.CacheKey(listUrl)
+	if !fresh {
+		cached, keys, err := c.getListCache(k)
+		if err != nil {
+			return err
+		}
+		var fetched int64
+		c.listCache.Get(k+"_fetched", &fetched)
+		// the cache index only keeps the ttl of entries put by this process
+		ttl := c.sourceTtl(listUrl)
+		var refresh int64
+		if c.listCache.Get(k+"_ttl", &refresh) == nil && refresh > 0 {
+			ttl = time.Duration(refresh)
+		}
+		if ttl > 0 && fetched > 0 && time.Since(time.Unix(0, fetched)) > ttl {
+			cached = nil
+		}
+		if len(cached) > 0 {
+			c.proxiesMu.Lock()
+			for ip, u := range cached {
+				proxies[ip] = u
+			}
+			for i, ip := range keys {
+				order[ip] = i
+			}
+			c.restoreMeta(k+"_meta", cached)
+			c.lastFetch, c.fromCache = time.Time{}, true
+			if fetched > 0 {
+				c.lastFetch = time.Unix(0, fetched)
+			}
+			c.proxiesMu.Unlock()
+			if !quiet {
+				c.added(cached)
+			}
+			if c.revalAfter > 0 && fetched > 0 && time.Since(time.Unix(0, fetched)) > c.revalAfter {
+				c.pruneCached()
+			}
+			return nil
+		}
+	}
+
+	c.emit(Event{Type: EventFetchStarted, Source: listUrl})
+	defer func() {
+		c.emit(Event{Type: EventFetchCompleted, Source: listUrl, Err: err})
+	}()
+	r, err := c.get(ctx, listUrl)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if isHTML(r, b) {
+		return ErrHTML
+	}
+	fetched := time.Now()
+	c.proxiesMu.Lock()
+	c.lastFetch, c.fromCache = fetched, false
+	c.proxiesMu.Unlock()
+	ttl := c.sourceTtl(listUrl)
+	if d := refreshAfter(r); d > 0 {
+		ttl = d
+	}
+
+	if err = c.parse(ctx, b, c.formatOf(r, b), quiet, proxies, order); err != nil {
+		return err
+	}
+
+	return c.putListCache(k, proxies, order, fetched, ttl)
+}
+
+// parse adds the proxies of the list b in format f to proxies and their
+// positions to order, validating them if set. Both are written under
+// proxiesMu. quiet skips the added events and OnProxyValidated calls, for
+// proxies that may not join the pool.
+func (c *client) parse(ctx context.Context, b []byte, f Format, quiet bool, proxies map[string]*url.URL, order map[string]int) (err error) {
+	if c.liftRLimits {
+		if _, err := h.LiftRLimits(); err != nil {
+			fmt.Fprintf(os.Stderr, "%s lifting rlimits, validating with the current limit\n", err)
+		}
+	}
+
+	if c.validate && c.rejectDirect && !c.reachOnly {
+		if _, err = c.cachedDirectIP(ctx); err != nil {
+			return fmt.Errorf("%s looking up the direct IP", err)
+		}
+	}
+
+	var run context.Context
+	var cancel context.CancelFunc
+	if c.validate && c.budget > 0 {
+		run, cancel = context.WithTimeout(ctx, c.budget)
+	} else {
+		run, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+	var parseErrs ParseErrors
+	lines, err := c.entries(b, f)
+	if err != nil {
+		return err
+	}
+	for i := range lines {
+		lines[i].pos = i
+	}
+	if c.shuffle {
+		rand.Shuffle(len(lines), func(i, j int) { lines[i], lines[j] = lines[j], lines[i] })
+	}
+
+	var done int64
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	if c.onProgress != nil {
+		go func() {
+			defer close(stopped)
+			t := time.NewTicker(progressInterval)
+			defer t.Stop()
+			for {
+				select {
+				case <-t.C:
+					c.onProgress(int(atomic.LoadInt64(&done)), len(lines))
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+
+	wg := h.NewWgExec(100)
+	lineOf := make(map[string]int)
+	// endpoints holds the host:port kept by SetCollapseEndpoints
+	endpoints := make(map[string]bool)
+	for i, l := range lines {
+		if run.Err() != nil {
+			break
+		}
+		wg.Run(func(p ...interface{}) {
+			defer atomic.AddInt64(&done, 1)
+			if run.Err() != nil {
+				return
+			}
+			e, i := p[0].(entry), p[1].(int)
+			ip, u, err := c.parseProxyLine(e.line)
+			if err != nil {
+				if c.strict {
+					c.proxiesMu.Lock()
+					parseErrs = append(parseErrs, err)
+					c.proxiesMu.Unlock()
+					return
+				}
+				fmt.Fprintf(os.Stderr, err.Error()+"\n")
+				return
+			}
+			country := c.country(e.country, u.Hostname())
+			if !c.wantedCountry(country) {
+				return
+			}
+			if c.collapse && c.collapsedEndpoint(endpoints, u.Host, false) {
+				return
+			}
+			var latency time.Duration
+			validated := c.validate && !c.lazy && (c.sampleRate >= 1 || rand.Float64() < c.sampleRate)
+			if validated {
+				key := ip
+				ip, latency, err = c.validateProxy(run, key, u)
+				if err != nil {
+					if c.quarantine && run.Err() == nil {
+						c.proxiesMu.Lock()
+						c.quarantined[key] = u
+						c.proxiesMu.Unlock()
+					}
+					return
+				}
+				if c.geoLookup != nil && !c.reachOnly {
+					if exit := c.country("", ip); exit != "" {
+						if !c.wantedCountry(exit) {
+							return
+						}
+						country = exit
+					}
+				}
+			}
+			if c.keyFunc != nil {
+				ip = c.keyFunc(ip, u)
+			}
+			if c.collapse && c.collapsedEndpoint(endpoints, u.Host, true) {
+				return
+			}
+			c.proxiesMu.Lock()
+			var added bool
+			if _, dup := proxies[ip]; dup {
+				added = c.replaces(ip, i, latency, lineOf)
+			} else {
+				added = c.maxProxies == 0 || len(proxies) < c.maxProxies
+			}
+			if added {
+				proxies[ip] = u
+				lineOf[ip] = i
+				order[ip] = e.pos
+				if validated {
+					m := c.meta(ip)
+					m.validated = true
+					m.latency = latency
+					m.validatedAt = time.Now()
+				}
+				if country != "" {
+					c.meta(ip).country = country
+				}
+				if e.weight > 0 {
+					c.meta(ip).score = e.weight
+				}
+			}
+			if c.maxProxies > 0 && len(proxies) >= c.maxProxies {
+				cancel()
+			}
+			c.proxiesMu.Unlock()
+			if quiet {
+				return
+			}
+			if added {
+				c.emit(Event{Type: EventProxyAdded, IP: ip, URL: u})
+			}
+			if added && validated && c.onValidated != nil {
+				c.onValidated(ip, u)
+			}
+		}, l, i)
+
+	}
+	wg.Wait()
+	if c.onProgress != nil {
+		close(stop)
+		<-stopped
+		c.onProgress(int(done), len(lines))
+	}
+	if c.ctx.Err() != nil {
+		return ErrClosed
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	if len(parseErrs) > 0 {
+		return parseErrs
+	}
+	c.proxiesMu.Lock()
+	empty := len(proxies) == 0
+	c.proxiesMu.Unlock()
+	if c.nonEmpty && empty {
+		return ErrNoProxies
+	}
+
+	return nil
 }
 
-func NewClient(listUrl string, cl *http.Client) (c *client, err error) {
-	if cl == nil {
-		cl = http.DefaultClient
-	}
+type DuplicatePolicy int
 
-	f, err := cachita.NewFileCache("/tmp/rsocks", 24*time.Hour, 1*time.Hour)
-	if err != nil {
-		return nil, err
-	}
-	return &client{Client: cl, listUrl: listUrl, listCache: f, proxies: make(map[string]*url.URL)}, nil
+const (
+	// KeepLast keeps the proxy of the last line that yields a key.
+	KeepLast DuplicatePolicy = iota
+	// KeepFirst keeps the proxy of the first line that yields a key.
+	KeepFirst
+	// KeepFastest keeps the proxy with the lowest validation latency,
+	// the first line winning among unmeasured ones.
+	KeepFastest
+)
+
+// SetDuplicatePolicy sets which proxy List() keeps when several lines yield
+// the same key, e.g. proxies sharing an exit IP, in a list or across the
+// lists added with AddListURL. Lines are ordered as dispatched, so SetShuffle
+// makes first and last random, and lists as added. Defaults to KeepLast.
+func (c *client) SetDuplicatePolicy(p DuplicatePolicy) {
+	c.duplicates = p
 }
 
-func (c *client) List() (map[string]*url.URL, error) {
-	k := fmt.Sprintf("list_%s", c.listUrl)
-	err := c.getListCache(k)
-	if err != nil && !cachita.IsErrorOk(err) {
-		return nil, err
+// replaces reports whether the proxy of line i with latency replaces the one
+// already stored under ip. lineOf holds the lines of the stored proxies,
+// those missing from it coming first. proxiesMu must be held.
+func (c *client) replaces(ip string, i int, latency time.Duration, lineOf map[string]int) bool {
+	j, ok := lineOf[ip]
+	if !ok {
+		j = -1
 	}
-	if len(c.proxies) > 0 {
-		return c.proxies, nil
+	switch c.duplicates {
+	case KeepFirst:
+		return i < j
+	case KeepFastest:
+		var old time.Duration
+		if m, ok := c.metas[ip]; ok {
+			old = m.latency
+		}
+		if latency > 0 && (old == 0 || latency < old) {
+			return true
+		}
+		return latency == old && i < j
+	default:
+		return i > j
 	}
+}
 
-	r, err := c.get(c.listUrl)
-	if err != nil {
-		return nil, err
+// entry is a proxy line of a list and what the list says about it.
+type entry struct {
+	line, country string
+	// weight is the score of the weight column, 0 without one
+	weight float64
+	// pos is the position of the entry in the list
+	pos int
+}
+
+// entries returns the proxy lines of a downloaded list with comments and
+// blank lines dropped.
+func (c *client) entries(b []byte, f Format) ([]entry, error) {
+	lines, err := c.formatEntries(b, f)
+	if err != nil || c.transform == nil && !c.weightColumn {
+		return lines, err
 	}
-	defer r.Body.Close()
-	b, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		return nil, err
+	kept := lines[:0]
+	for _, e := range lines {
+		if c.transform != nil {
+			e.line = c.transform(e.line)
+		}
+		if c.weightColumn {
+			e.line, e.weight = splitWeight(e.line)
+		}
+		if strings.TrimSpace(e.line) != "" {
+			kept = append(kept, e)
+		}
 	}
+	return kept, nil
+}
 
+func (c *client) formatEntries(b []byte, f Format) ([]entry, error) {
+	// ScanLines drops the \r of CRLF endings but not a leading BOM
+	b = bytes.TrimPrefix(b, []byte("\ufeff"))
+	if f != FormatText {
+		return c.csvEntries(b, f)
+	}
 	scanner := bufio.NewScanner(bytes.NewReader(b))
-
-	_, err = h.LiftRLimits()
-	h.PanicOnError(err)
-
-	wg := h.NewWgExec(100)
-	var l string
+	var lines []entry
 	for scanner.Scan() {
-		l = scanner.Text()
-		if l == "" {
+		l := stripComment(scanner.Text(), c.comment)
+		if strings.TrimSpace(l) == "" {
 			continue
 		}
-		wg.Run(func(p ...interface{}) {
-			line := p[0].(string)
-			ip, u, err := parseProxyLine(line)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, err.Error()+"\n")
-				return
-			}
-			c.proxiesMu.Lock()
-			c.proxies[ip] = u
-			c.proxiesMu.Unlock()
-		}, l)
+		lines = append(lines, entry{line: l})
+	}
+	return lines, nil
+}
 
+// refreshAfter returns how long the provider says the list r answered is
+// valid for in its X-Refresh-After header of seconds, 0 without one.
+func refreshAfter(r *http.Response) time.Duration {
+	s, err := strconv.Atoi(strings.TrimSpace(r.Header.Get("X-Refresh-After")))
+	if err != nil || s <= 0 {
+		return 0
 	}
-	wg.Wait()
+	return time.Duration(s) * time.Second
+}
 
-	err = c.putListCache(k)
-	if err != nil {
-		return nil, err
+// isHTML reports whether a list download is a web page, e.g. an error page
+// served with 200 by a misconfigured endpoint.
+func isHTML(r *http.Response, b []byte) bool {
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil && mt == "text/html" {
+		return true
+	}
+	b = bytes.TrimSpace(bytes.TrimPrefix(b, []byte("\ufeff")))
+	if len(b) > 15 {
+		b = b[:15]
 	}
+	b = bytes.ToLower(b)
+	return bytes.HasPrefix(b, []byte("<!doctype html")) || bytes.HasPrefix(b, []byte("<html"))
+}
 
-	return c.proxies, nil
+// PingSource checks that the list endpoint is reachable without downloading
+// the list. Non-2xx responses are returned as *APIError.
+func (c *client) PingSource(ctx context.Context) error {
+	r, err := request(ctx, c.httpClient(), http.MethodHead, c.listUrl, userAgent, c.listHeaders(), nil)
+	if err != nil {
+		return err
+	}
+	if r.StatusCode/100 != 2 {
+		return formatError(r)
+	}
+	r.Body.Close()
+	return nil
 }
 
 func (c *client) Type() int {
@@ -105,7 +1308,13 @@ func (c *client) Type() int {
 }
 
 func (c *client) Name() string {
-	return "rsocks"
+	return c.name
+}
+
+// SetName sets the name reported to quiver, to tell several clients apart.
+// Defaults to "rsocks".
+func (c *client) SetName(name string) {
+	c.name = name
 }
 
 func (c *client) Total() int {
@@ -114,27 +1323,139 @@ func (c *client) Total() int {
 	return len(c.proxies)
 }
 
-func (c *client) getListCache(k string) error {
-	l := make(map[string]string)
-	err := c.listCache.Get(k, &l)
+func (c *client) Contains(ip string) bool {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	_, ok := c.proxies[ip]
+	return ok
+}
+
+func (c *client) ContainsURL(u *url.URL) bool {
+	if u == nil {
+		return false
+	}
+	s := u.String()
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	for _, pu := range c.proxies {
+		if pu.String() == s {
+			return true
+		}
+	}
+	return false
+}
+
+// CountFunc returns how many proxies of the pool fn matches, without
+// copying it. fn is called with the client lock held so it must not call
+// the client.
+func (c *client) CountFunc(fn func(ip string, u *url.URL) bool) int {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	var n int
+	for ip, u := range c.proxies {
+		if fn(ip, u) {
+			n++
+		}
+	}
+	return n
+}
+
+// ProxiesByScheme returns a copy of the proxies whose URL scheme is scheme.
+func (c *client) ProxiesByScheme(scheme string) map[string]*url.URL {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	l := make(map[string]*url.URL)
+	for ip, u := range c.proxies {
+		if strings.EqualFold(u.Scheme, scheme) {
+			l[ip] = u
+		}
+	}
+	return l
+}
+
+// getListCache returns the list cached under k and its keys in list order.
+func (c *client) getListCache(k string) (map[string]*url.URL, []string, error) {
+	var shards int
+	err := c.listCache.Get(k+"_shards", &shards)
 	if err != nil && !cachita.IsErrorOk(err) {
-		return err
+		return nil, nil, cacheError(k+"_shards", err)
 	}
-	if len(l) > 0 {
-		for ip, u := range l {
-			c.proxies[ip] = h.ParseUrl(u)
+	l := make(map[string]string)
+	var order []string
+	if shards == 0 {
+		err = c.listCache.Get(k, &l)
+		if err != nil && !cachita.IsErrorOk(err) {
+			return nil, nil, cacheError(k, err)
 		}
+		c.listCache.Get(k+"_order", &order)
 	}
-	return nil
+	for i := 0; i < shards; i++ {
+		// shards hold ip, url pairs in list order
+		var pairs []string
+		sk := fmt.Sprintf("%s_shard_%d", k, i)
+		err = c.listCache.Get(sk, &pairs)
+		if cachita.IsErrorOk(err) {
+			// a partial list would pass for the whole one
+			return map[string]*url.URL{}, nil, nil
+		}
+		if err != nil {
+			return nil, nil, cacheError(sk, err)
+		}
+		for j := 0; j+1 < len(pairs); j += 2 {
+			l[pairs[j]] = pairs[j+1]
+			order = append(order, pairs[j])
+		}
+	}
+
+	proxies := make(map[string]*url.URL, len(l))
+	for ip, u := range l {
+		pu, err := url.Parse(u)
+		if err != nil {
+			return nil, nil, &CacheError{Key: k, Err: err, corrupt: true}
+		}
+		proxies[ip] = pu
+	}
+	return proxies, order, nil
 }
 
-func (c *client) putListCache(k string) error {
+func (c *client) putListCache(k string, proxies map[string]*url.URL, positions map[string]int, fetched time.Time, ttl time.Duration) error {
 	l := make(map[string]string)
-	for ip, u := range c.proxies {
+	c.proxiesMu.Lock()
+	order := make([]string, 0, len(proxies))
+	for ip, u := range proxies {
 		l[ip] = u.String()
+		order = append(order, ip)
 	}
+	sort.Slice(order, func(i, j int) bool { return before(positions, order[i], order[j]) })
+	c.proxiesMu.Unlock()
 
-	err := c.listCache.Put(k, &l, 0)
+	err := c.writeListCache(k, l, order, ttl)
+	if err != nil {
+		return err
+	}
+	n := fetched.UnixNano()
+	err = c.listCache.Put(k+"_fetched", &n, ttl)
+	if err != nil {
+		return err
+	}
+	d := int64(ttl)
+	err = c.listCache.Put(k+"_ttl", &d, ttl)
+	if err != nil {
+		return err
+	}
+	err = c.writeListCache(k+"_stale", l, order, staleTtl)
+	if err != nil {
+		return err
+	}
+	err = c.listCache.Put(k+"_stale_fetched", &n, staleTtl)
+	if err != nil {
+		return err
+	}
+	err = c.putMeta(k+"_meta", proxies, ttl)
+	if err != nil {
+		return err
+	}
+	err = c.putMeta(k+"_stale_meta", proxies, staleTtl)
 	if err != nil {
 		return err
 	}
@@ -142,39 +1463,380 @@ func (c *client) putListCache(k string) error {
 	return nil
 }
 
-func parseProxyLine(line string) (ipStr string, u *url.URL, err error) {
-	s := strings.Split(strings.TrimSpace(line), ":")
+// writeListCache caches l under k, split into shards of about the shard
+// size when it is larger.
+func (c *client) writeListCache(k string, l map[string]string, order []string, ttl time.Duration) error {
+	var size int
+	for ip, u := range l {
+		size += len(ip) + len(u)
+	}
+	if c.shardSize <= 0 || size <= c.shardSize {
+		err := c.listCache.Put(k, &l, ttl)
+		if err != nil {
+			return err
+		}
+		err = c.listCache.Put(k+"_order", &order, ttl)
+		if err != nil {
+			return err
+		}
+		shards := 0
+		return c.listCache.Put(k+"_shards", &shards, ttl)
+	}
 
-	var lu string
-	switch len(s) {
-	case 4:
-		lu = fmt.Sprintf("http://%s:%s@%s:%s", s[2], s[3], s[0], s[1])
-	case 2:
-		lu = fmt.Sprintf("http://%s:%s", s[0], s[1])
-	default:
-		return "", nil, fmt.Errorf("invalid proxy line %s", line)
+	var shards int
+	for start := 0; start < len(order); shards++ {
+		var pairs []string
+		for size = 0; start < len(order) && (len(pairs) == 0 || size < c.shardSize); start++ {
+			ip := order[start]
+			pairs = append(pairs, ip, l[ip])
+			size += len(ip) + len(l[ip])
+		}
+		err := c.listCache.Put(fmt.Sprintf("%s_shard_%d", k, shards), &pairs, ttl)
+		if err != nil {
+			return err
+		}
+	}
+	return c.listCache.Put(k+"_shards", &shards, ttl)
+}
+
+// loadStale adds the stale copy of the list cached under k to proxies and
+// reports whether there was one.
+func (c *client) loadStale(k string, proxies map[string]*url.URL) bool {
+	l, order, err := c.getListCache(k + "_stale")
+	if err != nil || len(l) == 0 {
+		return false
+	}
+	var fetched int64
+	c.listCache.Get(k+"_stale_fetched", &fetched)
+	c.proxiesMu.Lock()
+	for ip, u := range l {
+		proxies[ip] = u
+	}
+	for i, ip := range order {
+		c.order[ip] = i
+	}
+	c.restoreMeta(k+"_stale_meta", l)
+	c.lastFetch, c.fromCache = time.Unix(0, fetched), true
+	c.proxiesMu.Unlock()
+	c.added(l)
+	return true
+}
+
+const (
+	reasonFormat = "format"
+	reasonUrl    = "url"
+)
+
+// lineError is a list line parseProxyLine rejected and why.
+type lineError struct {
+	reason, msg string
+}
+
+func (e *lineError) Error() string {
+	return e.msg
+}
+
+func (c *client) parseProxyLine(line string) (ipStr string, u *url.URL, err error) {
+	l := strings.TrimSpace(line)
+	var scheme string
+	if i := strings.Index(l, "://"); i > 0 {
+		rest := l[i+3:]
+		if strings.ContainsAny(rest, "/?") {
+			// a gateway URL whose path or query is part of the proxy
+			return parseProxyURL(line, l)
+		}
+		if at := strings.LastIndex(rest, "@"); at >= 0 && strings.Contains(rest[at+1:], ":") {
+			// userinfo before host:port, rather than an @ in the password
+			// of a host:port:user:pass line
+			return parseProxyURL(line, l)
+		}
+		scheme, l = l[:i], l[i+3:]
+	}
+	// the password is the rest of the line so it may contain colons
+	s := strings.SplitN(l, ":", 4)
+	if len(s) != 4 && len(s) != 2 {
+		return "", nil, &lineError{reasonFormat, fmt.Sprintf("invalid proxy line %s", line)}
+	}
+	if scheme == "" {
+		scheme = c.portScheme(s[1])
+	}
+
+	pu := &url.URL{Scheme: scheme, Host: s[0] + ":" + s[1]}
+	if len(s) == 4 {
+		// escapes credentials like user@domain that would break the URL
+		pu.User = url.UserPassword(s[2], s[3])
 	}
+	lu := pu.String()
 
 	u, err = url.Parse(lu)
 	if err != nil {
-		return "", nil, fmt.Errorf("%s parsing line %s URL %s", err, line, lu)
+		return "", nil, &lineError{reasonUrl, fmt.Sprintf("%s parsing line %s URL %s", err, line, lu)}
 	}
 	ipStr = lu
 
 	return
 }
 
-func proxyIp(proxyUrl *url.URL) (ip string, err error) {
+// splitWeight cuts the weight column off line, which has one when it has
+// three or five and more fields.
+func splitWeight(line string) (string, float64) {
+	l := strings.TrimSpace(line)
+	rest := l
+	if i := strings.Index(rest, "://"); i > 0 {
+		rest = rest[i+3:]
+	}
+	if i := strings.Index(rest, "]"); strings.HasPrefix(rest, "[") && i > 0 {
+		// the colons of a bracketed IPv6 host aren't separators
+		rest = rest[i:]
+	}
+	if n := strings.Count(rest, ":"); n != 2 && n < 4 {
+		return line, 0
+	}
+	i := strings.LastIndex(l, ":")
+	w, err := strconv.ParseFloat(strings.TrimSpace(l[i+1:]), 64)
+	if err != nil || w < 0 {
+		return line, 0
+	}
+	return l[:i], w
+}
+
+func parseProxyURL(line, l string) (ipStr string, u *url.URL, err error) {
+	u, err = url.Parse(l)
+	if err != nil {
+		return "", nil, &lineError{reasonUrl, fmt.Sprintf("%s parsing line %s URL %s", err, line, l)}
+	}
+	if u.Hostname() == "" || u.Port() == "" {
+		return "", nil, &lineError{reasonFormat, fmt.Sprintf("invalid proxy line %s", line)}
+	}
+	return u.String(), u, nil
+}
+
+// stripComment cuts line at the first comment marker that isn't inside an
+// IPv6 bracketed address.
+func stripComment(line, comment string) string {
+	if comment == "" {
+		return line
+	}
+	depth := 0
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '[':
+			depth++
+		case ']':
+			if depth > 0 {
+				depth--
+			}
+		}
+		if depth == 0 && strings.HasPrefix(line[i:], comment) {
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func (c *client) portScheme(port string) string {
+	if p, err := strconv.Atoi(port); err == nil {
+		if s, ok := c.portSchemes[p]; ok {
+			return s
+		}
+	}
+	return c.scheme
+}
+
+// validator returns the http client validating through proxyUrl, reusing
+// one per proxy so keep-alive connections to the check endpoint survive
+// between validations. It clones the transport of the client lists are
+// downloaded with when that is an *http.Transport, so its dial and TLS
+// settings apply to validation too.
+func (c *client) validator(proxyUrl *url.URL) *http.Client {
+	var k string
+	if proxyUrl != nil {
+		k = proxyUrl.String()
+	}
+	base := c.httpClient()
+	c.validatorsMu.Lock()
+	defer c.validatorsMu.Unlock()
+	cl, ok := c.validators[k]
+	if !ok {
+		transport := &http.Transport{}
+		if bt, ok := base.Transport.(*http.Transport); ok && bt != nil {
+			transport = bt.Clone()
+		}
+		transport.Proxy = http.ProxyURL(proxyUrl)
+		if c.tlsConfig != nil {
+			transport.TLSClientConfig = c.tlsConfig
+		}
+		if c.resolver != nil {
+			transport.DialContext = resolvingDial(c.resolver, transport.DialContext)
+		}
+		timeout := 60 * time.Second
+		if base.Timeout > 0 {
+			timeout = base.Timeout
+		}
+		cl = &http.Client{Transport: transport, Timeout: timeout}
+		c.validators[k] = cl
+	}
+	return cl
+}
+
+// resolvingDial returns dial looking hostnames up with r first, so the
+// timeout and keep-alive of the dialer behind dial still apply. A nil dial
+// uses a zero net.Dialer.
+func resolvingDial(r *net.Resolver, dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	return func(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+		ips, err := r.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			if conn, err = dial(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+				return conn, nil
+			}
+		}
+		if err == nil {
+			err = fmt.Errorf("no addresses found for %s", host)
+		}
+		return nil, err
+	}
+}
+
+// dropValidators closes and forgets the validation clients of proxies that
+// aren't in keep. A nil keep drops them all.
+func (c *client) dropValidators(keep map[string]*url.URL) {
+	inPool := make(map[string]bool, len(keep))
+	for _, u := range keep {
+		inPool[u.String()] = true
+	}
+	c.validatorsMu.Lock()
+	defer c.validatorsMu.Unlock()
+	for k, cl := range c.validators {
+		if !inPool[k] {
+			cl.CloseIdleConnections()
+			delete(c.validators, k)
+		}
+	}
+}
+
+// dropValidator closes and forgets the validation client of the proxy at u.
+func (c *client) dropValidator(u *url.URL) {
+	if u == nil {
+		return
+	}
+	c.validatorsMu.Lock()
+	defer c.validatorsMu.Unlock()
+	if cl, ok := c.validators[u.String()]; ok {
+		cl.CloseIdleConnections()
+		delete(c.validators, u.String())
+	}
+}
+
+func (c *client) proxyIp(ctx context.Context, proxyUrl *url.URL) (ip string, err error) {
+	return c.checkIp(ctx, c.validator(proxyUrl), proxyUrl != nil)
+}
+
+// DirectIP returns the IP the check URL sees without a proxy, i.e. the
+// egress IP of this host.
+func (c *client) DirectIP(ctx context.Context) (string, error) {
+	ctx, cancel := c.context(ctx)
+	defer cancel()
+	// a nil proxy makes the check hit the endpoint directly
+	return c.proxyIp(ctx, nil)
+}
+
+// cachedDirectIP returns DirectIP, looking it up on the first call only.
+func (c *client) cachedDirectIP(ctx context.Context) (string, error) {
+	c.proxiesMu.Lock()
+	ip := c.directIp
+	c.proxiesMu.Unlock()
+	if ip != "" {
+		return ip, nil
+	}
+	ip, err := c.DirectIP(ctx)
+	if err != nil {
+		return "", err
+	}
+	c.proxiesMu.Lock()
+	c.directIp = ip
+	c.proxiesMu.Unlock()
+	return ip, nil
+}
+
+// validateProxy checks the proxy parsed as key and returns the key it's
+// stored under and how long the check took.
+func (c *client) validateProxy(ctx context.Context, key string, u *url.URL) (ip string, latency time.Duration, err error) {
+	release, err := c.acquireHost(ctx, u.Host)
+	if err != nil {
+		return "", 0, err
+	}
+	defer release()
+	start := time.Now()
+	ip, err = c.proxyIp(ctx, u)
+	if err == nil && c.reachOnly || ip == "" && (err == nil || err == errTLSIntercepted) {
+		// without an exit IP the proxy keeps its list key
+		ip = key
+	}
+	if err == errTLSIntercepted {
+		c.proxiesMu.Lock()
+		c.meta(ip).intercepted = true
+		c.proxiesMu.Unlock()
+	}
+	c.proxiesMu.Lock()
+	direct := c.directIp
+	c.proxiesMu.Unlock()
+	if err == nil && (c.rejectDirect && ip == direct || c.blockedExit(ip)) {
+		err = &checkError{failRejected, fmt.Sprintf("rejected exit IP %s", ip)}
+	}
+	if err != nil && ctx.Err() == nil {
+		c.validationFailed(key, u, err)
+	}
+	return ip, time.Since(start), err
+}
+
+// checkIp requests the check URL with cl and returns the IP it answers with.
+// The max latency applies to proxied clients only.
+func (c *client) checkIp(ctx context.Context, cl *http.Client, proxied bool) (ip string, err error) {
+	if c.maxLatency > 0 && proxied {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.maxLatency)
+		defer cancel()
+	}
 
-	transport := &http.Transport{Proxy: http.ProxyURL(proxyUrl)}
-	c := &http.Client{Transport: transport, Timeout: 60 * time.Second}
+	if len(c.checkUrls) == 0 {
+		return "", errors.New("no check URL")
+	}
+	start := int(atomic.AddUint32(&c.checkNext, 1) - 1)
+	for n := range c.checkUrls {
+		ip, err = c.checkIpAt(ctx, cl, c.checkUrls[(start+n)%len(c.checkUrls)])
+		if err == nil || err == errTLSIntercepted || ctx.Err() != nil || c.noRetry {
+			return
+		}
+	}
+	return
+}
 
+func (c *client) checkIpAt(ctx context.Context, cl *http.Client, checkUrl string) (ip string, err error) {
+	if c.reachOnly {
+		return "", reach(ctx, cl, checkUrl, c.userAgent())
+	}
+	var header http.Header
+	if c.check.contentType != "" {
+		header = http.Header{"Content-Type": {c.check.contentType}}
+	}
 	r, err := request(
-		c,
-		http.MethodGet,
-		"http://ifconfig.io/ip",
-		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/58.0.3029.81 Safari/537.36",
-		nil,
+		ctx,
+		cl,
+		c.check.method,
+		checkUrl,
+		c.userAgent(),
+		header,
+		bytes.NewReader(c.check.body),
 	)
 	if err != nil {
 		return
@@ -185,36 +1847,99 @@ func proxyIp(proxyUrl *url.URL) (ip string, err error) {
 	if err != nil {
 		return
 	}
-	if r.StatusCode != 200 {
-		return "", fmt.Errorf("invalid Status Code: %d", r.StatusCode)
+	if c.checkOk != nil {
+		return c.checkedIp(r, b)
+	}
+	if r.StatusCode != c.check.status {
+		return "", &checkError{failStatus, fmt.Sprintf("invalid Status Code: %d", r.StatusCode)}
+	}
+	if c.extractIp != nil {
+		ip, err = c.extractIp(b)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		ip = strings.TrimSpace(string(b))
 	}
-	ip = strings.TrimSpace(string(b))
 	if !h.IsValidIp(ip) {
-		return "", fmt.Errorf("invalid IP: %s", ip)
+		return "", &checkError{failBody, fmt.Sprintf("invalid IP: %s", ip)}
+	}
+	ip = canonicalIp(ip)
+	if c.intercepted(r) {
+		return ip, errTLSIntercepted
 	}
 
 	return
 }
-func (c *client) get(u string) (*http.Response, error) {
-	return retryRequest(c.Client, http.MethodGet, u, userAgent, nil)
+
+// checkedIp is checkIpAt for SetValidationSuccessFunc: the predicate
+// decides whether the proxy is alive and the IP extractor, if any, its key.
+func (c *client) checkedIp(r *http.Response, b []byte) (ip string, err error) {
+	if !c.checkOk(r.StatusCode, b) {
+		return "", &checkError{failStatus, fmt.Sprintf("check failed with status %d", r.StatusCode)}
+	}
+	if c.extractIp != nil {
+		if ip, err = c.extractIp(b); err != nil || !h.IsValidIp(ip) {
+			ip = ""
+		}
+	}
+	if ip != "" {
+		ip = canonicalIp(ip)
+	}
+	if c.intercepted(r) {
+		return ip, errTLSIntercepted
+	}
+	return ip, nil
+}
+
+// reach sends a HEAD request to checkUrl with cl and fails unless the answer
+// is 2xx.
+func reach(ctx context.Context, cl *http.Client, checkUrl, useragent string) error {
+	r, err := request(ctx, cl, http.MethodHead, checkUrl, useragent, nil, nil)
+	if err != nil {
+		return err
+	}
+	r.Body.Close()
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		return &checkError{failStatus, fmt.Sprintf("invalid Status Code: %d", r.StatusCode)}
+	}
+	return nil
+}
+
+func (c *client) get(ctx context.Context, u string) (*http.Response, error) {
+	strategy := c.retry
+	if c.noRetry {
+		strategy = noRetry{}
+	}
+	return retryRequest(ctx, c.httpClient(), strategy, http.MethodGet, u, userAgent, c.listHeaders(), nil)
 }
 
-func retryRequest(cl *http.Client, method, u, useragent string, body io.Reader) (resp *http.Response, err error) {
-	backoff.Retry(func() error {
-		resp, err = request(cl, method, u, useragent, body)
-		if resp != nil && resp.StatusCode >= http.StatusTooManyRequests {
-			return errors.New("try again")
+func retryRequest(ctx context.Context, cl *http.Client, strategy RetryStrategy, method, u, useragent string, header http.Header, body io.Reader) (resp *http.Response, err error) {
+	for attempt := 1; ; attempt++ {
+		resp, err = request(ctx, cl, method, u, useragent, header, body)
+		d, retry := strategy.NextDelay(attempt, resp, err)
+		if !retry {
+			return
 		}
-		return nil
-	}, backoff.NewExponentialBackOff())
-	return
+		if resp != nil {
+			resp.Body.Close()
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(d):
+		}
+	}
 }
 
-func request(cl *http.Client, method, u, useragent string, body io.Reader) (*http.Response, error) {
-	r, err := http.NewRequest(method, u, body)
+func request(ctx context.Context, cl *http.Client, method, u, useragent string, header http.Header, body io.Reader) (*http.Response, error) {
+	r, err := http.NewRequestWithContext(ctx, method, u, body)
 	if err != nil {
 		return nil, err
 	}
+	for k, v := range header {
+		r.Header[k] = v
+	}
 	r.Header.Set("User-Agent", useragent)
 
 	resp, err := cl.Do(r)
@@ -229,22 +1954,22 @@ func request(cl *http.Client, method, u, useragent string, body io.Reader) (*htt
 	return resp, nil
 }
 
-type apiError struct {
+type APIError struct {
 	err        string
 	statusCode int
 }
 
-func (a apiError) Error() string {
+func (a APIError) Error() string {
 	return a.err
 }
 
-func (a apiError) StatusCode() int {
+func (a APIError) StatusCode() int {
 	return a.statusCode
 }
 
 func formatError(r *http.Response) error {
 	defer r.Body.Close()
-	e := new(apiError)
+	e := new(APIError)
 	e.err = fmt.Sprintf("error statusCode code %d: %s", r.StatusCode, http.StatusText(r.StatusCode))
 	e.statusCode = r.StatusCode
 
@@ -0,0 +1,147 @@
+package rsocks
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	h "github.com/gadelkareem/go-helpers"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+type Format int
+
+const (
+	// FormatText is one host:port[:user:pass] proxy per line.
+	FormatText Format = iota
+	// FormatCSV and FormatTSV are spreadsheet exports with one proxy per
+	// row, see CSVColumns.
+	FormatCSV
+	FormatTSV
+	// FormatAuto picks one of the others for each download, from its
+	// Content-Type or else its first line, so lists in different formats
+	// can be merged with AddListURL.
+	FormatAuto
+)
+
+// CSVColumns names the header columns holding each proxy field. Lists
+// without a header row must have the columns in the order of the fields.
+type CSVColumns struct {
+	Host, Port, Username, Password, Country string
+}
+
+var DefaultCSVColumns = CSVColumns{Host: "host", Port: "port", Username: "username", Password: "password", Country: "country"}
+
+// SetFormat sets the format of the list.
+func (c *client) SetFormat(f Format) {
+	c.format = f
+}
+
+// SetCSVColumns sets the header names of the proxy fields in CSV and TSV
+// lists. Empty names keep the DefaultCSVColumns ones.
+func (c *client) SetCSVColumns(cols CSVColumns) {
+	d := DefaultCSVColumns
+	c.csvColumns = CSVColumns{
+		Host:     h.OneOf(cols.Host, d.Host),
+		Port:     h.OneOf(cols.Port, d.Port),
+		Username: h.OneOf(cols.Username, d.Username),
+		Password: h.OneOf(cols.Password, d.Password),
+		Country:  h.OneOf(cols.Country, d.Country),
+	}
+}
+
+// formatOf returns the format to parse the list downloaded with r as, r
+// being nil for lists that weren't downloaded.
+func (c *client) formatOf(r *http.Response, b []byte) Format {
+	if c.format != FormatAuto {
+		return c.format
+	}
+	if r != nil {
+		mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch mt {
+		case "text/csv":
+			return FormatCSV
+		case "text/tab-separated-values":
+			return FormatTSV
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(bytes.TrimPrefix(b, []byte("\ufeff"))))
+	for scanner.Scan() {
+		l := stripComment(scanner.Text(), c.comment)
+		if strings.TrimSpace(l) == "" {
+			continue
+		}
+		if strings.Contains(l, "\t") {
+			return FormatTSV
+		}
+		if strings.Contains(l, ",") {
+			return FormatCSV
+		}
+		break
+	}
+	return FormatText
+}
+
+func (c *client) csvEntries(b []byte, f Format) ([]entry, error) {
+	r := csv.NewReader(bytes.NewReader(b))
+	if f == FormatTSV {
+		r.Comma = '\t'
+	}
+	r.FieldsPerRecord = -1
+
+	cols := c.csvColumns
+	names := []string{cols.Host, cols.Port, cols.Username, cols.Password, cols.Country}
+	// field index → column, positional until a header says otherwise
+	idx := []int{0, 1, 2, 3, 4}
+	var lines []entry
+	for n := 0; ; n++ {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s reading CSV list", err)
+		}
+		if n == 0 && isHeader(rec, cols) {
+			for f, name := range names {
+				idx[f] = -1
+				for i, col := range rec {
+					if strings.EqualFold(strings.TrimSpace(col), name) {
+						idx[f] = i
+					}
+				}
+			}
+			continue
+		}
+		field := func(f int) string {
+			if idx[f] < 0 || idx[f] >= len(rec) {
+				return ""
+			}
+			return strings.TrimSpace(rec[idx[f]])
+		}
+		if field(0) == "" && field(1) == "" {
+			continue
+		}
+		l := field(0) + ":" + field(1)
+		if user := field(2); user != "" {
+			l += ":" + user + ":" + field(3)
+		}
+		lines = append(lines, entry{line: l, country: field(4)})
+	}
+	return lines, nil
+}
+
+// isHeader reports whether rec names the host and port columns.
+func isHeader(rec []string, cols CSVColumns) (host bool) {
+	var port bool
+	for _, col := range rec {
+		col = strings.TrimSpace(col)
+		host = host || strings.EqualFold(col, cols.Host)
+		port = port || strings.EqualFold(col, cols.Port)
+	}
+	return host && port
+}
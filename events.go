@@ -0,0 +1,108 @@
+package rsocks
+
+import (
+	"net/url"
+	"sync"
+	"time"
+)
+
+const defaultEventBuffer = 100
+
+type EventType int
+
+const (
+	// EventFetchStarted and EventFetchCompleted surround a list download,
+	// the latter carrying its error.
+	EventFetchStarted EventType = iota
+	EventFetchCompleted
+	// EventProxyAdded is sent when a proxy joins the pool, whether List()
+	// downloaded, validated or loaded it from the cache, or ImportState
+	// restored it.
+	EventProxyAdded
+	// EventProxyRemoved is sent when a proxy is pruned from the pool.
+	EventProxyRemoved
+	// EventProxyDead is sent by MarkDead.
+	EventProxyDead
+)
+
+// Event is a change of the pool. Source is the list URL of fetch events, IP
+// and URL the proxy of the others.
+type Event struct {
+	Type   EventType
+	Time   time.Time
+	Source string
+	IP     string
+	URL    *url.URL
+	Err    error
+}
+
+type events struct {
+	sync.RWMutex
+	ch     chan Event
+	size   int
+	block  bool
+	closed bool
+}
+
+// SetEventBuffer sets the buffer size of the Events() channel and whether a
+// full buffer blocks the pool operation sending the event, until it's read or
+// the client is closed, rather than dropping the event. It must be called
+// before Events(). Defaults to 100 and dropping.
+func (c *client) SetEventBuffer(n int, block bool) {
+	c.events.Lock()
+	defer c.events.Unlock()
+	c.events.size, c.events.block = n, block
+}
+
+// Events returns the channel pool changes are sent to. It's closed by
+// Close().
+func (c *client) Events() <-chan Event {
+	c.events.Lock()
+	defer c.events.Unlock()
+	if c.events.ch == nil {
+		c.events.ch = make(chan Event, c.events.size)
+		if c.events.closed {
+			close(c.events.ch)
+		}
+	}
+	return c.events.ch
+}
+
+// emit sends e if Events() was called. proxiesMu must not be held as a
+// blocking send waits for the consumer.
+func (c *client) emit(e Event) {
+	c.events.RLock()
+	defer c.events.RUnlock()
+	if c.events.ch == nil || c.events.closed {
+		return
+	}
+	e.Time = time.Now()
+	if c.events.block {
+		select {
+		case c.events.ch <- e:
+		case <-c.ctx.Done():
+		}
+		return
+	}
+	select {
+	case c.events.ch <- e:
+	default:
+	}
+}
+
+// added reports the proxies of l as added to the pool. proxiesMu must not be
+// held.
+func (c *client) added(l map[string]*url.URL) {
+	for ip, u := range l {
+		c.emit(Event{Type: EventProxyAdded, IP: ip, URL: u})
+	}
+}
+
+func (c *client) closeEvents() {
+	c.events.Lock()
+	defer c.events.Unlock()
+	if c.events.ch != nil && !c.events.closed {
+		close(c.events.ch)
+	}
+	c.events.closed = true
+}
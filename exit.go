@@ -0,0 +1,89 @@
+package rsocks
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// SetExitIPBlocklist makes validation drop proxies whose exit IP is in one
+// of cidrs. IPv4 and IPv6 ranges may be mixed and a bare IP blocks just that
+// address.
+func (c *client) SetExitIPBlocklist(cidrs []string) error {
+	var l []*net.IPNet
+	for _, s := range cidrs {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil {
+				if ip.To4() != nil {
+					s += "/32"
+				} else {
+					s += "/128"
+				}
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return fmt.Errorf("%s parsing blocklist entry %s", err, s)
+		}
+		l = append(l, n)
+	}
+	c.blocklist = l
+	return nil
+}
+
+func (c *client) blockedExit(ip string) bool {
+	if len(c.blocklist) == 0 {
+		return false
+	}
+	parsed := net.ParseIP(ip)
+	for _, n := range c.blocklist {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalIp returns ip in its canonical form, so the different spellings
+// of an IPv6 address and IPv4-mapped IPv6 addresses key the same exit.
+func canonicalIp(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		return parsed.String()
+	}
+	return ip
+}
+
+// subnet returns the /24 of an IPv4 or the /64 of an IPv6 exit ip, or ""
+// when ip isn't an IP, e.g. the key of an unvalidated proxy.
+func subnet(ip string) string {
+	return subnetOf(ip, 24)
+}
+
+// subnetOf is subnet with the /mask of IPv4 exits.
+func subnetOf(ip string, mask int) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	m := net.CIDRMask(64, 128)
+	if v4 := parsed.To4(); v4 != nil {
+		parsed, m = v4, net.CIDRMask(mask, 32)
+	}
+	n := net.IPNet{IP: parsed.Mask(m), Mask: m}
+	return n.String()
+}
+
+// DistinctSubnets returns how many /mask subnets the validated IPv4 exits of
+// the pool span, each IPv6 exit counting by its /64.
+func (c *client) DistinctSubnets(mask int) int {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	seen := make(map[string]bool)
+	for ip := range c.proxies {
+		if n := subnetOf(ip, mask); n != "" {
+			seen[n] = true
+		}
+	}
+	return len(seen)
+}
@@ -0,0 +1,29 @@
+package rsocks
+
+var StripComment = stripComment
+
+// ExpireList drops the cached copy of the list at listUrl, leaving the stale
+// one.
+func (c *client) ExpireList(listUrl string) error {
+	return c.listCache.Invalidate(c.CacheKey(listUrl))
+}
+
+// CacheShards returns the number of shards the list at listUrl is cached in.
+func (c *client) CacheShards(listUrl string) int {
+	var n int
+	c.listCache.Get(c.CacheKey(listUrl)+"_shards", &n)
+	return n
+}
+
+// CorruptList caches a value under the key of the list at listUrl that
+// doesn't decode as a list.
+func (c *client) CorruptList(listUrl string) error {
+	return c.listCache.Put(c.CacheKey(listUrl), "garbage", 0)
+}
+
+// Validators returns the number of cached validation clients.
+func (c *client) Validators() int {
+	c.validatorsMu.Lock()
+	defer c.validatorsMu.Unlock()
+	return len(c.validators)
+}
@@ -0,0 +1,80 @@
+package rsocks
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/url"
+	"syscall"
+)
+
+const (
+	failTimeout  = "timeout"
+	failRefused  = "refused"
+	failStatus   = "status"
+	failBody     = "body"
+	failTLS      = "tls"
+	failRejected = "rejected"
+	failOther    = "other"
+)
+
+// checkError is a check response validation rejected and why.
+type checkError struct {
+	reason, msg string
+}
+
+func (e *checkError) Error() string {
+	return e.msg
+}
+
+// OnValidationFailed registers fn to be called as each proxy fails
+// validation, keyed as parsed, with the reason: "timeout", "refused" when
+// the proxy refused the connection, "status" for an unexpected status of the
+// check endpoint, "body" for an answer without a valid IP, "tls" for TLS
+// failures and interception, "rejected" for exit IPs rejected by
+// SetRejectDirectIP or the blocklist and "other". Stats().Failures counts
+// them.
+func (c *client) OnValidationFailed(fn func(ip string, u *url.URL, reason string, err error)) {
+	c.onFailed = fn
+}
+
+// validationFailed records the failed validation of the proxy parsed as key.
+func (c *client) validationFailed(key string, u *url.URL, err error) {
+	reason := failureReason(err)
+	c.proxiesMu.Lock()
+	c.failures[reason]++
+	c.proxiesMu.Unlock()
+	if c.onFailed != nil {
+		c.onFailed(key, u, reason, err)
+	}
+}
+
+// failureReason returns why a validation failed with err.
+func failureReason(err error) string {
+	var ce *checkError
+	if errors.As(err, &ce) {
+		return ce.reason
+	}
+	if _, ok := err.(*APIError); ok {
+		return failStatus
+	}
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &ne) && ne.Timeout() {
+		return failTimeout
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return failRefused
+	}
+	var (
+		rh tls.RecordHeaderError
+		ua x509.UnknownAuthorityError
+		ci x509.CertificateInvalidError
+		he x509.HostnameError
+	)
+	if err == errTLSIntercepted || errors.As(err, &rh) || errors.As(err, &ua) || errors.As(err, &ci) || errors.As(err, &he) {
+		return failTLS
+	}
+	return failOther
+}
@@ -0,0 +1,38 @@
+package rsocks
+
+import (
+	"strings"
+)
+
+// SetGeoLookup sets fn to return the country code of an IP, e.g. from a
+// local GeoIP database. It must not make requests through proxies, it is
+// called for each list entry.
+func (c *client) SetGeoLookup(fn func(ip string) string) {
+	c.geoLookup = fn
+}
+
+// SetValidateCountries makes List() keep only proxies in one of countries,
+// given as country codes. Entries whose country, from the list or the host
+// by SetGeoLookup, is another are dropped without being validated, and
+// validated proxies whose exit IP SetGeoLookup places elsewhere are dropped
+// after. Proxies of unknown country are kept. No countries keeps them all.
+func (c *client) SetValidateCountries(countries []string) {
+	c.countries = make(map[string]bool, len(countries))
+	for _, cc := range countries {
+		c.countries[strings.ToUpper(strings.TrimSpace(cc))] = true
+	}
+}
+
+// country returns the country of ip by the list entry or SetGeoLookup.
+func (c *client) country(listed, ip string) string {
+	if listed == "" && c.geoLookup != nil {
+		listed = c.geoLookup(ip)
+	}
+	return listed
+}
+
+// wantedCountry reports whether proxies in country pass
+// SetValidateCountries.
+func (c *client) wantedCountry(country string) bool {
+	return len(c.countries) == 0 || country == "" || c.countries[strings.ToUpper(country)]
+}
@@ -0,0 +1,166 @@
+package rsocks
+
+import (
+	"net/url"
+	"time"
+)
+
+type proxyMeta struct {
+	attempts, successes int
+	dead, validated     bool
+	latency             time.Duration
+	country             string
+	deadAt              time.Time
+	intercepted         bool
+	// checked is set once lazy validation checked the proxy
+	checked   bool
+	udp       bool
+	anonymity Anonymity
+	// validatedAt is when the proxy last passed validation
+	validatedAt time.Time
+	// score is the provider weight of SetWeightColumn
+	score float64
+	// interval and nextCheck schedule StartSmartRevalidation
+	interval  time.Duration
+	nextCheck time.Time
+}
+
+// meta returns the record of ip, creating it. proxiesMu must be held.
+func (c *client) meta(ip string) *proxyMeta {
+	m, ok := c.metas[ip]
+	if !ok {
+		m = new(proxyMeta)
+		c.metas[ip] = m
+	}
+	return m
+}
+
+// MarkAlive records a successful use of the proxy stored under ip.
+func (c *client) MarkAlive(ip string) {
+	c.MarkAliveBulk([]string{ip})
+}
+
+// MarkDead records a failed use of the proxy stored under ip.
+func (c *client) MarkDead(ip string) {
+	c.MarkDeadBulk([]string{ip})
+}
+
+// MarkAliveBulk is MarkAlive for several proxies at once and returns how
+// many of them are in the pool.
+func (c *client) MarkAliveBulk(ips []string) (found int) {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	for _, ip := range ips {
+		if _, ok := c.proxies[ip]; !ok {
+			continue
+		}
+		found++
+		m := c.meta(ip)
+		m.attempts++
+		m.successes++
+		m.dead = false
+	}
+	return
+}
+
+// MarkDeadBulk is MarkDead for several proxies at once and returns how many
+// of them are in the pool.
+func (c *client) MarkDeadBulk(ips []string) (found int) {
+	c.proxiesMu.Lock()
+	var dead []Event
+	now := time.Now()
+	for _, ip := range ips {
+		u, ok := c.proxies[ip]
+		if !ok {
+			continue
+		}
+		m := c.meta(ip)
+		m.attempts++
+		m.dead = true
+		m.deadAt = now
+		dead = append(dead, Event{Type: EventProxyDead, IP: ip, URL: u})
+	}
+	c.proxiesMu.Unlock()
+	for _, e := range dead {
+		c.emit(e)
+	}
+	return len(dead)
+}
+
+// SetDeadCooldown makes RandomProxy, NextProxy, WeightedProxy, SampleProxies
+// and BestProxy skip proxies for d after MarkDead, after which they are
+// picked again. Zero, the default, never skips them.
+func (c *client) SetDeadCooldown(d time.Duration) {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	c.deadCooldown = d
+}
+
+// coolingDown reports whether ip is skipped by selection after MarkDead.
+// proxiesMu must be held.
+func (c *client) coolingDown(ip string) bool {
+	m, ok := c.metas[ip]
+	return ok && m.dead && c.deadCooldown > 0 && time.Since(m.deadAt) < c.deadCooldown
+}
+
+// SuccessRate returns the ratio of MarkAlive calls to all Mark calls for ip.
+// ok is false when ip was never marked.
+func (c *client) SuccessRate(ip string) (rate float64, ok bool) {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	m, ok := c.metas[ip]
+	if !ok || m.attempts == 0 {
+		return 0, false
+	}
+	return float64(m.successes) / float64(m.attempts), true
+}
+
+// Validated reports whether the proxy stored under ip passed validation in
+// List(), as opposed to being kept unchecked by the sample rate.
+func (c *client) Validated(ip string) bool {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	m, ok := c.metas[ip]
+	return ok && m.validated
+}
+
+// BestProxy returns the proxy with the highest success rate, preferring
+// validated proxies and then the lower measured latency on ties. Proxies
+// never marked rank as 50% so new ones still get picked over mostly failing
+// ones.
+func (c *client) BestProxy() (ip string, u *url.URL, err error) {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	var best *proxyMeta
+	bestRate := -1.0
+	for k, pu := range c.proxies {
+		if c.coolingDown(k) || c.leased(k) {
+			continue
+		}
+		m := c.metas[k]
+		if m == nil {
+			m = new(proxyMeta)
+		}
+		rate := float64(m.successes+1) / float64(m.attempts+2)
+		if m.validated {
+			// ranks any validated proxy above every unchecked one
+			rate += 1
+		}
+		if rate > bestRate || rate == bestRate && (fasterThan(m, best) || !fasterThan(best, m) && k < ip) {
+			ip, u, best, bestRate = k, pu, m, rate
+		}
+	}
+	if u == nil {
+		return "", nil, ErrNoProxies
+	}
+	return
+}
+
+// fasterThan reports whether a has a lower latency than b, a measured latency
+// beating an unmeasured one.
+func fasterThan(a, b *proxyMeta) bool {
+	if a.latency == 0 {
+		return false
+	}
+	return b.latency == 0 || a.latency < b.latency
+}
@@ -0,0 +1,69 @@
+package rsocks
+
+import (
+	"math/rand"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const defaultLeaseTimeout = 10 * time.Minute
+
+// Lease is a proxy kept out of the other selections until released, for
+// workflows that need the same exit for several calls.
+type Lease struct {
+	IP  string
+	URL *url.URL
+
+	c     *client
+	once  sync.Once
+	timer *time.Timer
+}
+
+// Release gives the proxy back to the pool. Calling it again, or after the
+// lease expired, does nothing.
+func (l *Lease) Release() {
+	l.once.Do(func() {
+		// the timer is set under proxiesMu
+		l.c.proxiesMu.Lock()
+		l.timer.Stop()
+		if l.c.leases[l.IP] == l {
+			delete(l.c.leases, l.IP)
+		}
+		l.c.proxiesMu.Unlock()
+	})
+}
+
+// SetLeaseTimeout sets how long a Lease lasts when it isn't released, 10
+// minutes by default. It applies to the leases taken after.
+func (c *client) SetLeaseTimeout(d time.Duration) {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	c.leaseTimeout = d
+}
+
+// Lease picks a random proxy and keeps it out of RandomProxy, NextProxy and
+// the other selections until the lease is released or times out.
+func (c *client) Lease() (*Lease, error) {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	keys := c.eligible()
+	if len(keys) == 0 {
+		return nil, ErrNoProxies
+	}
+	ip := keys[rand.Intn(len(keys))]
+	l := &Lease{IP: ip, URL: c.withSession(ip, c.proxies[ip]), c: c}
+	timeout := c.leaseTimeout
+	if timeout <= 0 {
+		timeout = defaultLeaseTimeout
+	}
+	l.timer = time.AfterFunc(timeout, l.Release)
+	c.leases[ip] = l
+	return l, nil
+}
+
+// leased reports whether ip is held by a Lease. proxiesMu must be held.
+func (c *client) leased(ip string) bool {
+	_, ok := c.leases[ip]
+	return ok
+}
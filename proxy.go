@@ -0,0 +1,120 @@
+package rsocks
+
+import (
+	"math/rand"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// Proxy is a copy of a pool entry along with what the client knows about it.
+type Proxy struct {
+	IP        string
+	URL       *url.URL
+	Latency   time.Duration
+	Validated bool
+	Tags      []string
+	Country   string
+	// UDP is set once SupportsUDP found the proxy granting UDP ASSOCIATE.
+	UDP bool
+	// Weight is the provider score read by SetWeightColumn.
+	Weight float64
+}
+
+// Redacted returns the proxy URL without its credentials, for logging.
+func (p Proxy) Redacted() string {
+	if p.URL == nil {
+		return ""
+	}
+	u := *p.URL
+	u.User = nil
+	return u.String()
+}
+
+// record builds the Proxy stored under ip. proxiesMu must be held.
+func (c *client) record(ip string, u *url.URL) Proxy {
+	p := Proxy{IP: ip, URL: u, Tags: append([]string(nil), c.tags[u.Host]...)}
+	if m, ok := c.metas[ip]; ok {
+		p.Latency = m.latency
+		p.Validated = m.validated
+		p.Country = m.country
+		p.UDP = m.udp
+		p.Weight = m.score
+	}
+	return p
+}
+
+// Proxy returns the record of the proxy stored under ip.
+func (c *client) Proxy(ip string) (Proxy, bool) {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	u, ok := c.proxies[ip]
+	if !ok {
+		return Proxy{}, false
+	}
+	return c.record(ip, u), true
+}
+
+// ProxiesInLatencyRange returns the validated proxies whose measured latency
+// is in [min, max), fastest first.
+func (c *client) ProxiesInLatencyRange(min, max time.Duration) []Proxy {
+	c.proxiesMu.Lock()
+	var l []Proxy
+	for ip, u := range c.proxies {
+		m, ok := c.metas[ip]
+		if !ok || !m.validated || m.latency == 0 || m.latency < min || m.latency >= max {
+			continue
+		}
+		l = append(l, c.record(ip, u))
+	}
+	c.proxiesMu.Unlock()
+
+	sort.Slice(l, func(i, j int) bool { return l[i].Latency < l[j].Latency })
+	return l
+}
+
+// OrderedProxies returns the proxies in the order of their lines in the list.
+// Proxies whose position isn't known, e.g. imported ones, come last.
+func (c *client) OrderedProxies() []Proxy {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	ips := make([]string, 0, len(c.proxies))
+	for ip := range c.proxies {
+		ips = append(ips, ip)
+	}
+	sort.Slice(ips, func(i, j int) bool { return before(c.order, ips[i], ips[j]) })
+
+	l := make([]Proxy, len(ips))
+	for i, ip := range ips {
+		l[i] = c.record(ip, c.proxies[ip])
+	}
+	return l
+}
+
+// ShuffledProxies returns the pool in an order shuffled by seed, the same
+// for every call with the seed as long as the pool doesn't change.
+func (c *client) ShuffledProxies(seed int64) []Proxy {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	keys := c.keys()
+	rand.New(rand.NewSource(seed)).Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+	l := make([]Proxy, len(keys))
+	for i, ip := range keys {
+		l[i] = c.record(ip, c.proxies[ip])
+	}
+	return l
+}
+
+// before reports whether a came before b in the list, ordering unknown
+// positions last and by key. proxiesMu must be held for the pool order.
+func before(order map[string]int, a, b string) bool {
+	pa, oka := order[a]
+	pb, okb := order[b]
+	if oka != okb {
+		return oka
+	}
+	if oka && pa != pb {
+		return pa < pb
+	}
+	return a < b
+}
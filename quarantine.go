@@ -0,0 +1,69 @@
+package rsocks
+
+import (
+	"context"
+	h "github.com/gadelkareem/go-helpers"
+	"net/url"
+	"time"
+)
+
+// SetQuarantine makes List() keep the proxies that fail validation aside
+// rather than dropping them, so Requalify can check them again later.
+func (c *client) SetQuarantine(v bool) {
+	c.quarantine = v
+}
+
+// Quarantined returns the proxies that failed validation, keyed as parsed.
+func (c *client) Quarantined() map[string]*url.URL {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	l := make(map[string]*url.URL, len(c.quarantined))
+	for k, u := range c.quarantined {
+		l[k] = u
+	}
+	return l
+}
+
+// Requalify validates the quarantined proxies again and moves the ones that
+// pass to the pool, returning how many did.
+func (c *client) Requalify(ctx context.Context) (promoted int, err error) {
+	if c.ctx.Err() != nil {
+		return 0, ErrClosed
+	}
+	c.workers.Add(1)
+	defer c.workers.Done()
+	ctx, cancel := c.context(ctx)
+	defer cancel()
+
+	l := c.Quarantined()
+	wg := h.NewWgExec(100)
+	for k, u := range l {
+		wg.Run(func(p ...interface{}) {
+			k, u := p[0].(string), p[1].(*url.URL)
+			if ctx.Err() != nil {
+				return
+			}
+			ip, latency, err := c.validateProxy(ctx, k, u)
+			if err != nil {
+				return
+			}
+			c.proxiesMu.Lock()
+			delete(c.quarantined, k)
+			_, dup := c.proxies[ip]
+			if !dup {
+				c.proxies[ip] = u
+				m := c.meta(ip)
+				m.validated = true
+				m.latency = latency
+				m.validatedAt = time.Now()
+				promoted++
+			}
+			c.proxiesMu.Unlock()
+			if !dup {
+				c.emit(Event{Type: EventProxyAdded, IP: ip, URL: u})
+			}
+		}, k, u)
+	}
+	wg.Wait()
+	return promoted, ctx.Err()
+}
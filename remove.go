@@ -0,0 +1,82 @@
+package rsocks
+
+import (
+	"math/rand"
+	"net/url"
+)
+
+// OnProxyRemoved registers fn to be called with the key of each proxy that
+// leaves the pool, through RemoveProxy, TakeProxy, DrainDead,
+// PrewarmForTargets, SetListURL, SwapSource or ImportState. It's called
+// without the client lock held.
+func (c *client) OnProxyRemoved(fn func(ip string)) {
+	c.onRemoved = fn
+}
+
+// RemoveProxy drops the proxy stored under ip from the pool and reports
+// whether it was there.
+func (c *client) RemoveProxy(ip string) bool {
+	c.proxiesMu.Lock()
+	u, ok := c.proxies[ip]
+	delete(c.proxies, ip)
+	c.proxiesMu.Unlock()
+	if ok {
+		c.removed(map[string]*url.URL{ip: u})
+	}
+	return ok
+}
+
+// TakeProxy returns a random proxy and drops it from the pool, so each
+// proxy is taken once however many goroutines call it.
+func (c *client) TakeProxy() (ip string, u *url.URL, err error) {
+	c.proxiesMu.Lock()
+	keys := c.eligible()
+	if len(keys) == 0 {
+		c.proxiesMu.Unlock()
+		return "", nil, ErrNoProxies
+	}
+	ip = keys[rand.Intn(len(keys))]
+	pu := c.proxies[ip]
+	u = c.withSession(ip, pu)
+	delete(c.proxies, ip)
+	c.proxiesMu.Unlock()
+	c.removed(map[string]*url.URL{ip: pu})
+	return ip, u, nil
+}
+
+// DrainDead drops the proxies whose last Mark call was MarkDead and returns
+// how many there were.
+func (c *client) DrainDead() int {
+	c.proxiesMu.Lock()
+	l := make(map[string]*url.URL)
+	for ip, u := range c.proxies {
+		if m, ok := c.metas[ip]; ok && m.dead {
+			l[ip] = u
+			delete(c.proxies, ip)
+		}
+	}
+	c.proxiesMu.Unlock()
+	c.removed(l)
+	return len(l)
+}
+
+// removed reports the proxies of l as gone from the pool and drops their
+// validation clients and what was learned about them, so proxies listed
+// again start afresh. proxiesMu must not be held.
+func (c *client) removed(l map[string]*url.URL) {
+	c.proxiesMu.Lock()
+	for ip := range l {
+		// unless it was added back meanwhile
+		if _, ok := c.proxies[ip]; !ok {
+			delete(c.metas, ip)
+		}
+	}
+	c.proxiesMu.Unlock()
+	for ip, u := range l {
+		c.dropValidator(u)
+		c.emit(Event{Type: EventProxyRemoved, IP: ip, URL: u})
+		if c.onRemoved != nil {
+			c.onRemoved(ip)
+		}
+	}
+}
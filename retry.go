@@ -0,0 +1,86 @@
+package rsocks
+
+import (
+	"github.com/cenkalti/backoff"
+	"math"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// RetryStrategy decides whether retryRequest tries again after attempt,
+// starting at 1, got resp or err, and how long it waits first.
+type RetryStrategy interface {
+	NextDelay(attempt int, resp *http.Response, err error) (time.Duration, bool)
+}
+
+// ExponentialRetry retries rate limited and failing requests, those with a
+// status of 429 or more, with the exponential backoff of the backoff
+// package. It is the default RetryStrategy.
+type ExponentialRetry struct {
+	InitialInterval     time.Duration
+	RandomizationFactor float64
+	Multiplier          float64
+	MaxInterval         time.Duration
+	// MaxElapsedTime stops retrying once the waits add up to it.
+	MaxElapsedTime time.Duration
+}
+
+// defaultRetryElapsed bounds the retries of the default strategy, so the
+// fallback URL and ServeStaleOnError take over within seconds.
+const defaultRetryElapsed = 3 * time.Second
+
+// NewExponentialRetry returns the intervals of the backoff package, retrying
+// for up to 3 seconds of waits rather than its 15 minutes.
+func NewExponentialRetry() *ExponentialRetry {
+	return &ExponentialRetry{
+		InitialInterval:     backoff.DefaultInitialInterval,
+		RandomizationFactor: backoff.DefaultRandomizationFactor,
+		Multiplier:          backoff.DefaultMultiplier,
+		MaxInterval:         backoff.DefaultMaxInterval,
+		MaxElapsedTime:      defaultRetryElapsed,
+	}
+}
+
+func (e *ExponentialRetry) NextDelay(attempt int, resp *http.Response, err error) (time.Duration, bool) {
+	if retryStatus(resp, err) < http.StatusTooManyRequests {
+		return 0, false
+	}
+	var elapsed time.Duration
+	for i := 1; i <= attempt; i++ {
+		elapsed += e.interval(i)
+	}
+	if e.MaxElapsedTime > 0 && elapsed > e.MaxElapsedTime {
+		return 0, false
+	}
+	d := e.interval(attempt)
+	delta := e.RandomizationFactor * float64(d)
+	return time.Duration(float64(d) - delta + rand.Float64()*(2*delta+1)), true
+}
+
+func (e *ExponentialRetry) interval(attempt int) time.Duration {
+	d := float64(e.InitialInterval) * math.Pow(e.Multiplier, float64(attempt-1))
+	if d > float64(e.MaxInterval) {
+		return e.MaxInterval
+	}
+	return time.Duration(d)
+}
+
+// noRetry never retries, see SetNoRetry.
+type noRetry struct{}
+
+func (noRetry) NextDelay(int, *http.Response, error) (time.Duration, bool) {
+	return 0, false
+}
+
+// retryStatus returns the status of resp, or of err when request turned it
+// into an APIError, and 0 otherwise.
+func retryStatus(resp *http.Response, err error) int {
+	if resp != nil {
+		return resp.StatusCode
+	}
+	if a, ok := err.(*APIError); ok {
+		return a.StatusCode()
+	}
+	return 0
+}
@@ -0,0 +1,211 @@
+package rsocks
+
+import (
+	"context"
+	h "github.com/gadelkareem/go-helpers"
+	"net/url"
+	"time"
+)
+
+// SetRevalidationTTL makes ValidateAll skip proxies that passed validation
+// less than d ago. Zero, the default, checks them all.
+func (c *client) SetRevalidationTTL(d time.Duration) {
+	c.revalTtl = d
+}
+
+// SetRevalidateAfter makes List() validate the proxies it loads from a
+// cached list older than d in the background, dropping the ones that fail,
+// rather than downloading the list again before its ttl. Zero, the default,
+// serves cached proxies as they are.
+func (c *client) SetRevalidateAfter(d time.Duration) {
+	c.revalAfter = d
+}
+
+// pruneCached runs ValidateAll in the background and drops the proxies it
+// found dead.
+func (c *client) pruneCached() {
+	c.workers.Add(1)
+	go func() {
+		defer c.workers.Done()
+		if _, err := c.ValidateAll(c.ctx); err == nil {
+			c.DrainDead()
+		}
+	}()
+}
+
+// ValidateAll validates the proxies of the pool again, marking the ones that
+// fail dead and the others alive, and returns how many it checked.
+func (c *client) ValidateAll(ctx context.Context) (checked int, err error) {
+	if c.ctx.Err() != nil {
+		return 0, ErrClosed
+	}
+	c.workers.Add(1)
+	defer c.workers.Done()
+	ctx, cancel := c.context(ctx)
+	defer cancel()
+
+	c.proxiesMu.Lock()
+	l := make(map[string]*url.URL, len(c.proxies))
+	for ip, u := range c.proxies {
+		if m, ok := c.metas[ip]; ok && c.revalTtl > 0 && time.Since(m.validatedAt) < c.revalTtl {
+			continue
+		}
+		l[ip] = u
+	}
+	c.proxiesMu.Unlock()
+
+	wg := h.NewWgExec(100)
+	for ip, u := range l {
+		wg.Run(func(p ...interface{}) {
+			ip, u := p[0].(string), p[1].(*url.URL)
+			if ctx.Err() != nil {
+				return
+			}
+			_, latency, err := c.validateProxy(ctx, ip, u)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				c.MarkDead(ip)
+			} else {
+				c.MarkAlive(ip)
+			}
+			c.proxiesMu.Lock()
+			checked++
+			if _, ok := c.proxies[ip]; ok && err == nil {
+				m := c.meta(ip)
+				m.validated, m.latency, m.validatedAt = true, latency, time.Now()
+			}
+			c.proxiesMu.Unlock()
+		}, ip, u)
+	}
+	wg.Wait()
+	return checked, ctx.Err()
+}
+
+// StartSmartRevalidation re-validates the proxies of the pool in the
+// background, each on its own interval: base at first, doubling up to max
+// after every successful check and back to base after a failed one, which
+// also marks the proxy dead. Due proxies are checked up to 100 at a time. It
+// replaces a running revalidation.
+func (c *client) StartSmartRevalidation(base, max time.Duration) {
+	c.StopSmartRevalidation()
+	ctx, cancel := context.WithCancel(c.ctx)
+	done := make(chan struct{})
+	c.revalMu.Lock()
+	c.stopReval, c.revalDone = cancel, done
+	c.revalMu.Unlock()
+
+	c.workers.Add(1)
+	go func() {
+		defer c.workers.Done()
+		defer close(done)
+		c.revalidate(ctx, base, max)
+	}()
+}
+
+// StopSmartRevalidation stops the revalidation started by
+// StartSmartRevalidation and waits for its running check.
+func (c *client) StopSmartRevalidation() {
+	c.revalMu.Lock()
+	stop, done := c.stopReval, c.revalDone
+	c.stopReval, c.revalDone = nil, nil
+	c.revalMu.Unlock()
+	if stop != nil {
+		stop()
+		<-done
+	}
+}
+
+func (c *client) revalidate(ctx context.Context, base, max time.Duration) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		wg := h.NewWgExec(100)
+		for ip, u := range c.dueProxies(time.Now(), base) {
+			wg.Run(func(p ...interface{}) {
+				ip, u := p[0].(string), p[1].(*url.URL)
+				if ctx.Err() != nil {
+					return
+				}
+				_, latency, err := c.validateProxy(ctx, ip, u)
+				if ctx.Err() != nil {
+					return
+				}
+				c.reschedule(ip, err == nil, latency, base, max)
+			}, ip, u)
+		}
+		wg.Wait()
+		if ctx.Err() != nil {
+			return
+		}
+		timer.Reset(c.nextRevalidation(base))
+	}
+}
+
+// dueProxies returns the proxies whose check is due at now, scheduling the
+// new ones for now.
+func (c *client) dueProxies(now time.Time, base time.Duration) map[string]*url.URL {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	due := make(map[string]*url.URL)
+	for ip, u := range c.proxies {
+		m := c.meta(ip)
+		if m.nextCheck.IsZero() {
+			m.interval, m.nextCheck = base, now
+		}
+		if !m.nextCheck.After(now) {
+			due[ip] = u
+		}
+	}
+	return due
+}
+
+// reschedule records the outcome of the check of ip and schedules the next.
+func (c *client) reschedule(ip string, ok bool, latency, base, max time.Duration) {
+	if ok {
+		c.MarkAlive(ip)
+	} else {
+		c.MarkDead(ip)
+	}
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	if _, in := c.proxies[ip]; !in {
+		return
+	}
+	m := c.meta(ip)
+	if ok {
+		m.latency, m.validated, m.validatedAt = latency, true, time.Now()
+		if m.interval *= 2; m.interval > max {
+			m.interval = max
+		}
+	} else {
+		m.interval = base
+	}
+	m.nextCheck = time.Now().Add(m.interval)
+}
+
+// nextRevalidation returns how long until the next due check, base when the
+// pool is empty.
+func (c *client) nextRevalidation(base time.Duration) time.Duration {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	var next time.Time
+	for ip := range c.proxies {
+		if m, ok := c.metas[ip]; ok && !m.nextCheck.IsZero() && (next.IsZero() || m.nextCheck.Before(next)) {
+			next = m.nextCheck
+		}
+	}
+	if next.IsZero() {
+		return base
+	}
+	if d := time.Until(next); d > 0 {
+		return d
+	}
+	return 0
+}
@@ -0,0 +1,145 @@
+package rsocks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+var ErrProxiesBusy = errors.New("rsocks: every proxy is at its connection limit")
+
+// RoundTripper returns an http.RoundTripper sending each request through the
+// next proxy of the pool, as picked by NextProxy. Proxies are marked alive
+// when they answer and dead when the request fails, so SetDeadCooldown
+// keeps failing proxies out of the rotation for a while.
+func (c *client) RoundTripper() http.RoundTripper {
+	return &roundTripper{c: c}
+}
+
+type roundTripper struct {
+	c *client
+}
+
+func (rt *roundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	ip, u, release, err := rt.c.acquireProxy(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	resp, err := rt.c.transport(u).RoundTrip(r)
+	if err != nil {
+		release()
+		if r.Context().Err() == nil {
+			rt.c.MarkDead(ip)
+		}
+		return nil, err
+	}
+	rt.c.MarkAlive(ip)
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// releasingBody gives the connection slot of its proxy back once closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// SetMaxConnsPerProxy caps the requests RoundTripper has in flight through
+// each proxy, skipping proxies at the cap. When every proxy is, a request
+// waits for a free slot if block is set and fails with ErrProxiesBusy
+// otherwise. Zero, the default, doesn't cap them.
+func (c *client) SetMaxConnsPerProxy(n int, block bool) {
+	c.connsMu.Lock()
+	defer c.connsMu.Unlock()
+	c.maxConns, c.connsBlock = n, block
+}
+
+// acquireProxy picks the proxy of the next request and takes one of its
+// connection slots, returned by release.
+func (c *client) acquireProxy(ctx context.Context) (ip string, u *url.URL, release func(), err error) {
+	for {
+		n := c.Total()
+		// taken before the pass so slots freed during it aren't missed
+		c.connsMu.Lock()
+		freed, block := c.connFreed, c.connsBlock
+		c.connsMu.Unlock()
+
+		// a pass over the rotation looking for a proxy under the cap, picked
+		// without connsMu as lazy validation may check it first
+		for i := 0; i < n || i == 0; i++ {
+			ip, u, err = c.NextProxy()
+			if err != nil {
+				return "", nil, nil, err
+			}
+			if c.takeConn(ip) {
+				var once sync.Once
+				return ip, u, func() { once.Do(func() { c.releaseConn(ip) }) }, nil
+			}
+		}
+		if !block {
+			return "", nil, nil, ErrProxiesBusy
+		}
+
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return "", nil, nil, ctx.Err()
+		case <-c.ctx.Done():
+			return "", nil, nil, ErrClosed
+		}
+	}
+}
+
+// takeConn takes a connection slot of ip if it has one left.
+func (c *client) takeConn(ip string) bool {
+	c.connsMu.Lock()
+	defer c.connsMu.Unlock()
+	if c.maxConns > 0 && c.conns[ip] >= c.maxConns {
+		return false
+	}
+	c.conns[ip]++
+	return true
+}
+
+func (c *client) releaseConn(ip string) {
+	c.connsMu.Lock()
+	defer c.connsMu.Unlock()
+	if c.conns[ip]--; c.conns[ip] <= 0 {
+		delete(c.conns, ip)
+	}
+	// wakes the requests waiting for a slot
+	close(c.connFreed)
+	c.connFreed = make(chan struct{})
+}
+
+// transport returns the transport of the requests through u.
+func (c *client) transport(u *url.URL) *http.Transport {
+	k := u.String()
+	c.connsMu.Lock()
+	defer c.connsMu.Unlock()
+	t, ok := c.transports[k]
+	if !ok {
+		t = &http.Transport{Proxy: http.ProxyURL(u)}
+		c.transports[k] = t
+	}
+	return t
+}
+
+// closeTransports closes the idle connections of RoundTripper.
+func (c *client) closeTransports() {
+	c.connsMu.Lock()
+	defer c.connsMu.Unlock()
+	for k, t := range c.transports {
+		t.CloseIdleConnections()
+		delete(c.transports, k)
+	}
+}
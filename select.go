@@ -0,0 +1,269 @@
+package rsocks
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// RandomProxy returns a random proxy of the pool.
+func (c *client) RandomProxy() (ip string, u *url.URL, err error) {
+	return c.pick(func(keys []string) string {
+		return keys[rand.Intn(len(keys))]
+	})
+}
+
+// RandomProxyExcluding returns a random proxy whose key isn't in exclude,
+// or ErrNoProxies when they all are.
+func (c *client) RandomProxyExcluding(exclude map[string]bool) (ip string, u *url.URL, err error) {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	var keys []string
+	for _, k := range c.eligible() {
+		if !exclude[k] {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return "", nil, ErrNoProxies
+	}
+	ip = keys[rand.Intn(len(keys))]
+	return ip, c.withSession(ip, c.proxies[ip]), nil
+}
+
+// RandomProxyDistinctSubnet returns a random proxy whose exit IP subnet, /24
+// for IPv4 and /64 for IPv6, isn't in used and adds that subnet to used, so
+// passing the same map again picks another subnet. A nil used picks from
+// every subnet and records nothing. Proxies keyed by something else than an
+// exit IP are skipped; it returns ErrNoProxies when no proxy is left.
+func (c *client) RandomProxyDistinctSubnet(used map[string]bool) (ip string, u *url.URL, err error) {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	var keys []string
+	for _, k := range c.eligible() {
+		if n := subnet(k); n != "" && !used[n] {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return "", nil, ErrNoProxies
+	}
+	ip = keys[rand.Intn(len(keys))]
+	if used != nil {
+		used[subnet(ip)] = true
+	}
+	return ip, c.withSession(ip, c.proxies[ip]), nil
+}
+
+// NextProxy returns the proxies of the pool in turn.
+func (c *client) NextProxy() (ip string, u *url.URL, err error) {
+	return c.pick(func(keys []string) string {
+		ip := keys[c.next%len(keys)]
+		c.next++
+		return ip
+	})
+}
+
+// pick returns the proxy choose picks from the eligible keys. With lazy
+// validation an unchecked pick is validated first and choose is asked again
+// without it when it fails. choose is called with proxiesMu held.
+func (c *client) pick(choose func(keys []string) string) (ip string, u *url.URL, err error) {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	tried := make(map[string]bool)
+	for {
+		var keys []string
+		for _, k := range c.eligible() {
+			if m, ok := c.metas[k]; !tried[k] && !(ok && m.checked && !m.validated) {
+				keys = append(keys, k)
+			}
+		}
+		if len(keys) == 0 {
+			return "", nil, ErrNoProxies
+		}
+		ip = choose(keys)
+		u = c.proxies[ip]
+		if m, ok := c.metas[ip]; !c.lazy || !c.validate || ok && m.checked {
+			return ip, c.withSession(ip, u), nil
+		}
+
+		tried[ip] = true
+		c.proxiesMu.Unlock()
+		_, latency, err := c.validateProxy(c.ctx, ip, u)
+		c.proxiesMu.Lock()
+		if c.ctx.Err() != nil {
+			return "", nil, ErrClosed
+		}
+		m := c.meta(ip)
+		m.checked = true
+		if err == nil {
+			m.validated, m.latency, m.validatedAt = true, latency, time.Now()
+			return ip, c.withSession(ip, u), nil
+		}
+	}
+}
+
+// WeightedProxy returns a random proxy, picking fast and reliable proxies
+// more often as described by SampleProxies.
+func (c *client) WeightedProxy() (ip string, u *url.URL, err error) {
+	l, err := c.SampleProxies(1)
+	if err != nil {
+		return "", nil, err
+	}
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	return l[0].IP, c.withSession(l[0].IP, l[0].URL), nil
+}
+
+// SampleProxies returns up to k distinct proxies drawn at random with a
+// weight of their success rate over their latency, proxies without a
+// measured latency counting as a one second one. It returns the whole pool
+// when k is larger than it and none when k isn't positive.
+func (c *client) SampleProxies(k int) ([]Proxy, error) {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	if len(c.proxies) == 0 {
+		return nil, ErrNoProxies
+	}
+	if k <= 0 {
+		return []Proxy{}, nil
+	}
+
+	// weighted sampling without replacement (Efraimidis-Spirakis): keep the
+	// k largest rand^(1/weight)
+	type drawn struct {
+		ip  string
+		key float64
+	}
+	l := make([]drawn, 0, len(c.proxies))
+	for _, ip := range c.eligible() {
+		l = append(l, drawn{ip, math.Pow(rand.Float64(), 1/c.weight(ip))})
+	}
+	if len(l) == 0 {
+		return nil, ErrNoProxies
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].key > l[j].key })
+	if k < len(l) {
+		l = l[:k]
+	}
+
+	ps := make([]Proxy, len(l))
+	for i, d := range l {
+		ps[i] = c.record(d.ip, c.proxies[d.ip])
+	}
+	return ps, nil
+}
+
+// weight returns the selection weight of ip. proxiesMu must be held.
+func (c *client) weight(ip string) float64 {
+	m, ok := c.metas[ip]
+	if !ok {
+		return 0.5
+	}
+	w := float64(m.successes+1) / float64(m.attempts+2)
+	if m.latency > 0 {
+		w *= float64(time.Second) / float64(m.latency)
+	}
+	if m.score > 0 {
+		w *= m.score
+	}
+	return w
+}
+
+// keys returns the pool keys sorted. proxiesMu must be held.
+func (c *client) keys() []string {
+	keys := make([]string, 0, len(c.proxies))
+	for ip := range c.proxies {
+		keys = append(keys, ip)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// eligible returns the sorted keys selection may pick, leaving out proxies
+// cooling down after MarkDead and leased ones. proxiesMu must be held.
+func (c *client) eligible() []string {
+	var keys []string
+	for _, ip := range c.keys() {
+		if !c.coolingDown(ip) && !c.leased(ip) {
+			keys = append(keys, ip)
+		}
+	}
+	return keys
+}
+
+// SetSessionTemplate rewrites the username of proxies returned by
+// RandomProxy and NextProxy to fmt.Sprintf(tmpl, username, session), e.g.
+// "%s-session-%s", so gateways keep the same exit for a proxy until its
+// session is rotated. An empty template disables it.
+func (c *client) SetSessionTemplate(tmpl string) {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	c.sessionTmpl = tmpl
+}
+
+// RotateSession gives the proxy stored under ip a new session so the
+// gateway picks a new exit for it.
+func (c *client) RotateSession(ip string) {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	delete(c.sessions, ip)
+}
+
+// IsSticky checks the exit IP through u samples times, at least twice, and
+// reports whether it stayed the same, telling sticky proxies from rotating
+// gateways.
+func (c *client) IsSticky(ctx context.Context, u *url.URL, samples int) (bool, error) {
+	ctx, cancel := c.context(ctx)
+	defer cancel()
+	var first string
+	for i := 0; i < samples || i < 2; i++ {
+		ip, err := c.proxyIp(ctx, u)
+		if err != nil {
+			return false, err
+		}
+		if i == 0 {
+			first = ip
+		} else if ip != first {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// sessionToken returns a random session id. It reads crypto/rand rather than
+// reseeding the global math/rand source selection relies on.
+func sessionToken() string {
+	b := make([]byte, 5)
+	if _, err := crand.Read(b); err != nil {
+		rand.Read(b)
+	}
+	return hex.EncodeToString(b)
+}
+
+// withSession returns u with the session of ip applied to its username.
+// proxiesMu must be held.
+func (c *client) withSession(ip string, u *url.URL) *url.URL {
+	if c.sessionTmpl == "" || u.User == nil {
+		return u
+	}
+	s, ok := c.sessions[ip]
+	if !ok {
+		s = sessionToken()
+		c.sessions[ip] = s
+	}
+	su := *u
+	user := fmt.Sprintf(c.sessionTmpl, u.User.Username(), s)
+	if pass, ok := u.User.Password(); ok {
+		su.User = url.UserPassword(user, pass)
+	} else {
+		su.User = url.User(user)
+	}
+	return &su
+}
@@ -0,0 +1,121 @@
+package rsocks
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+)
+
+type source struct {
+	url string
+	ttl time.Duration
+}
+
+// AddListURL adds a list whose proxies List() merges into the pool after
+// those of the list URL, SetDuplicatePolicy picking among proxies sharing a
+// key, the lists ordered as added after the list URL. Each list is cached
+// for its own ttl, zero meaning the cache default, so a list still cached is
+// served from the cache while an expired one is downloaded again. Adding the
+// list URL itself only sets its ttl.
+func (c *client) AddListURL(u string, ttl time.Duration) {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	for i := range c.sources {
+		if c.sources[i].url == u {
+			c.sources[i].ttl = ttl
+			return
+		}
+	}
+	c.sources = append(c.sources, source{url: u, ttl: ttl})
+}
+
+// sourceTtl returns the cache ttl of the list at u.
+func (c *client) sourceTtl(u string) time.Duration {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	for _, src := range c.sources {
+		if src.url == u {
+			return src.ttl
+		}
+	}
+	return 0
+}
+
+// loadSources merges the added lists into proxies and their positions into
+// order, quietly as in parse if set. A list that fails to load is logged and
+// skipped.
+func (c *client) loadSources(proxies map[string]*url.URL, order map[string]int, quiet bool) {
+	c.proxiesMu.Lock()
+	sources := append([]source(nil), c.sources...)
+	listUrl := c.listUrl
+	// LastFetch keeps reporting the list URL
+	lastFetch, fromCache := c.lastFetch, c.fromCache
+	c.proxiesMu.Unlock()
+	defer func() {
+		c.proxiesMu.Lock()
+		c.lastFetch, c.fromCache = lastFetch, fromCache
+		c.proxiesMu.Unlock()
+	}()
+
+	// the proxies of each list are ordered after those loaded before
+	c.proxiesMu.Lock()
+	next := 0
+	for ip := range proxies {
+		if pos, ok := order[ip]; ok && pos >= next {
+			next = pos + 1
+		}
+	}
+	c.proxiesMu.Unlock()
+	for _, src := range sources {
+		if src.url == listUrl || src.url == c.fallbackUrl {
+			continue
+		}
+		// the latencies the pool had, as loading the list measures its own
+		c.proxiesMu.Lock()
+		latencies := make(map[string]time.Duration, len(proxies))
+		for ip := range proxies {
+			if m, ok := c.metas[ip]; ok {
+				latencies[ip] = m.latency
+			}
+		}
+		c.proxiesMu.Unlock()
+		l, srcOrder := make(map[string]*url.URL), make(map[string]int)
+		if err := c.load(c.ctx, src.url, false, quiet, l, srcOrder); err != nil {
+			fmt.Fprintf(os.Stderr, "%s loading %s\n", err, src.url)
+			continue
+		}
+		c.proxiesMu.Lock()
+		last := next
+		for ip, u := range l {
+			if _, ok := proxies[ip]; ok {
+				// a duplicate is resolved by SetDuplicatePolicy and keeps the
+				// position it was first listed at
+				var latency time.Duration
+				m, measured := c.metas[ip]
+				if measured {
+					latency, m.latency = m.latency, latencies[ip]
+				}
+				if c.replaces(ip, next+srcOrder[ip], latency, order) {
+					proxies[ip] = u
+					if measured {
+						m.latency = latency
+					}
+				}
+				continue
+			}
+			if c.maxProxies > 0 && len(proxies) >= c.maxProxies {
+				continue
+			}
+			proxies[ip] = u
+			if pos, ok := srcOrder[ip]; ok {
+				order[ip] = next + pos
+				if next+pos >= last {
+					last = next + pos + 1
+				}
+			}
+		}
+		next = last
+		c.proxiesMu.Unlock()
+	}
+}
@@ -0,0 +1,96 @@
+package rsocks
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+type state struct {
+	ListUrl   string       `json:"list_url"`
+	LastFetch time.Time    `json:"last_fetch"`
+	Proxies   []proxyState `json:"proxies"`
+}
+
+type proxyState struct {
+	IP        string        `json:"ip"`
+	URL       string        `json:"url"`
+	Latency   time.Duration `json:"latency,omitempty"`
+	Attempts  int           `json:"attempts,omitempty"`
+	Successes int           `json:"successes,omitempty"`
+	Dead      bool          `json:"dead,omitempty"`
+	Validated bool          `json:"validated,omitempty"`
+	Tags      []string      `json:"tags,omitempty"`
+	Country   string        `json:"country,omitempty"`
+	Weight    float64       `json:"weight,omitempty"`
+}
+
+// ExportState returns the pool along with the latency, health and tags
+// learned about each proxy as JSON, for ImportState after a restart.
+func (c *client) ExportState() ([]byte, error) {
+	c.proxiesMu.Lock()
+	st := state{ListUrl: c.listUrl, LastFetch: c.lastFetch}
+	for _, ip := range c.keys() {
+		u := c.proxies[ip]
+		ps := proxyState{IP: ip, URL: u.String(), Tags: c.tags[u.Host]}
+		if m, ok := c.metas[ip]; ok {
+			ps.Latency, ps.Attempts, ps.Successes = m.latency, m.attempts, m.successes
+			ps.Dead, ps.Validated = m.dead, m.validated
+			ps.Country, ps.Weight = m.country, m.score
+		}
+		st.Proxies = append(st.Proxies, ps)
+	}
+	c.proxiesMu.Unlock()
+
+	return json.Marshal(st)
+}
+
+// ImportState replaces the pool and what is known about its proxies with a
+// state returned by ExportState.
+func (c *client) ImportState(b []byte) error {
+	var st state
+	err := json.Unmarshal(b, &st)
+	if err != nil {
+		return err
+	}
+	proxies := make(map[string]*url.URL, len(st.Proxies))
+	metas := make(map[string]*proxyMeta, len(st.Proxies))
+	tags := make(map[string][]string)
+	for _, ps := range st.Proxies {
+		u, err := url.Parse(ps.URL)
+		if err != nil {
+			return fmt.Errorf("%s parsing state proxy %s", err, ps.IP)
+		}
+		proxies[ps.IP] = u
+		metas[ps.IP] = &proxyMeta{
+			attempts:  ps.Attempts,
+			successes: ps.Successes,
+			dead:      ps.Dead,
+			validated: ps.Validated,
+			latency:   ps.Latency,
+			country:   ps.Country,
+			score:     ps.Weight,
+		}
+		if len(ps.Tags) > 0 {
+			tags[u.Host] = ps.Tags
+		}
+	}
+
+	c.proxiesMu.Lock()
+	gone := make(map[string]*url.URL)
+	for ip, u := range c.proxies {
+		if _, ok := proxies[ip]; !ok {
+			gone[ip] = u
+		}
+	}
+	if st.ListUrl != "" {
+		c.listUrl = st.ListUrl
+	}
+	c.lastFetch, c.fromCache = st.LastFetch, true
+	c.proxies, c.metas, c.tags = proxies, metas, tags
+	c.proxiesMu.Unlock()
+	c.removed(gone)
+	c.added(proxies)
+	return nil
+}
@@ -0,0 +1,73 @@
+package rsocks
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+type Stats struct {
+	Total, Live, Dead int
+	AvgLatency        time.Duration
+	LastFetch         time.Time
+	// Collapsed counts the duplicate endpoints SetCollapseEndpoints dropped
+	// from the last download.
+	Collapsed int
+	// Failures counts the failed validations by reason, as passed to
+	// OnValidationFailed.
+	Failures map[string]int
+}
+
+// Stats returns a snapshot of the pool. Dead counts proxies whose last Mark
+// call was MarkDead; AvgLatency covers the proxies with a measured latency.
+func (c *client) Stats() Stats {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	s := Stats{Total: len(c.proxies), LastFetch: c.lastFetch, Collapsed: c.collapsed}
+	s.Failures = make(map[string]int, len(c.failures))
+	for reason, n := range c.failures {
+		s.Failures[reason] = n
+	}
+	var sum time.Duration
+	var measured int
+	for ip := range c.proxies {
+		m, ok := c.metas[ip]
+		if ok && m.dead {
+			s.Dead++
+		}
+		if ok && m.latency > 0 {
+			sum += m.latency
+			measured++
+		}
+	}
+	s.Live = s.Total - s.Dead
+	if measured > 0 {
+		s.AvgLatency = sum / time.Duration(measured)
+	}
+	return s
+}
+
+// WritePrometheus writes Stats() in the Prometheus text exposition format.
+func (c *client) WritePrometheus(w io.Writer) error {
+	s := c.Stats()
+	var age float64
+	if !s.LastFetch.IsZero() {
+		age = time.Since(s.LastFetch).Seconds()
+	}
+	for _, m := range []struct {
+		name, help string
+		value      float64
+	}{
+		{"rsocks_proxies", "Proxies in the pool.", float64(s.Total)},
+		{"rsocks_proxies_live", "Proxies not marked dead.", float64(s.Live)},
+		{"rsocks_proxies_dead", "Proxies marked dead.", float64(s.Dead)},
+		{"rsocks_latency_avg_seconds", "Average measured proxy latency.", s.AvgLatency.Seconds()},
+		{"rsocks_last_fetch_age_seconds", "Seconds since the list was last downloaded.", age},
+	} {
+		_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", m.name, m.help, m.name, m.name, m.value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
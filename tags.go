@@ -0,0 +1,53 @@
+package rsocks
+
+import (
+	h "github.com/gadelkareem/go-helpers"
+	"net/url"
+	"strings"
+)
+
+// LoadTags reads a sidecar file mapping proxy endpoints to tags, one
+// "host:port tag1,tag2" entry per line, replacing any tags loaded before.
+func (c *client) LoadTags(path string) error {
+	lines, err := h.FileToArray(path)
+	if err != nil {
+		return err
+	}
+	tags := make(map[string][]string)
+	for _, l := range lines {
+		f := strings.Fields(strings.Replace(stripComment(l, c.comment), ",", " ", -1))
+		if len(f) < 2 {
+			continue
+		}
+		tags[f[0]] = append(tags[f[0]], f[1:]...)
+	}
+
+	c.proxiesMu.Lock()
+	c.tags = tags
+	c.proxiesMu.Unlock()
+	return nil
+}
+
+// Tags returns the tags loaded for the proxy stored under ip.
+func (c *client) Tags(ip string) []string {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	u, ok := c.proxies[ip]
+	if !ok {
+		return nil
+	}
+	return append([]string(nil), c.tags[u.Host]...)
+}
+
+// ProxiesByTag returns a copy of the proxies tagged with tag.
+func (c *client) ProxiesByTag(tag string) map[string]*url.URL {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	l := make(map[string]*url.URL)
+	for ip, u := range c.proxies {
+		if h.InArray(tag, c.tags[u.Host]) {
+			l[ip] = u
+		}
+	}
+	return l
+}
@@ -0,0 +1,112 @@
+package rsocks
+
+import (
+	"context"
+	"fmt"
+	h "github.com/gadelkareem/go-helpers"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// CanReach requests target through the proxy stored under ip and fails
+// unless it answers with wantStatus.
+func (c *client) CanReach(ctx context.Context, ip, target string, wantStatus int) error {
+	c.proxiesMu.Lock()
+	u, ok := c.proxies[ip]
+	c.proxiesMu.Unlock()
+	if !ok {
+		return fmt.Errorf("no proxy %s", ip)
+	}
+	return c.reachTarget(ctx, u, target, wantStatus)
+}
+
+func (c *client) reachTarget(ctx context.Context, u *url.URL, target string, wantStatus int) error {
+	ctx, cancel := c.context(ctx)
+	defer cancel()
+	status := 0
+	r, err := request(ctx, c.validator(u), http.MethodGet, target, c.userAgent(), nil, nil)
+	if e, ok := err.(*APIError); ok {
+		status, err = e.StatusCode(), nil
+	}
+	if err != nil {
+		return err
+	}
+	if r != nil {
+		r.Body.Close()
+		status = r.StatusCode
+	}
+	if status != wantStatus {
+		return fmt.Errorf("%s answered %d through %s, want %d", target, status, u.Host, wantStatus)
+	}
+	return nil
+}
+
+// PrewarmForTarget checks the whole pool with CanReach and drops the proxies
+// that fail, returning how many are kept. Proxies left unchecked when ctx is
+// done are kept and ctx.Err() is returned.
+func (c *client) PrewarmForTarget(ctx context.Context, target string, wantStatus int) (kept int, err error) {
+	kept, _, err = c.PrewarmForTargets(ctx, []string{target}, wantStatus)
+	return
+}
+
+// PrewarmForTargets is PrewarmForTarget keeping only the proxies that reach
+// every target. passes counts the proxies each target answered through.
+func (c *client) PrewarmForTargets(ctx context.Context, targets []string, wantStatus int) (kept int, passes map[string]int, err error) {
+	if c.ctx.Err() != nil {
+		return 0, nil, ErrClosed
+	}
+	c.workers.Add(1)
+	defer c.workers.Done()
+	ctx, cancel := c.context(ctx)
+	defer cancel()
+
+	c.proxiesMu.Lock()
+	pool := make(map[string]*url.URL, len(c.proxies))
+	for ip, u := range c.proxies {
+		pool[ip] = u
+	}
+	c.proxiesMu.Unlock()
+
+	var mu sync.Mutex
+	failed := make(map[string]bool)
+	passes = make(map[string]int, len(targets))
+	wg := h.NewWgExec(100)
+	for ip, u := range pool {
+		wg.Run(func(p ...interface{}) {
+			ip, u := p[0].(string), p[1].(*url.URL)
+			for _, target := range targets {
+				if ctx.Err() != nil {
+					return
+				}
+				err := c.reachTarget(ctx, u, target, wantStatus)
+				mu.Lock()
+				if err == nil {
+					passes[target]++
+				} else if ctx.Err() == nil {
+					failed[ip] = true
+				}
+				mu.Unlock()
+			}
+		}, ip, u)
+	}
+	wg.Wait()
+
+	c.proxiesMu.Lock()
+	l := make(map[string]*url.URL, len(c.proxies))
+	gone := make(map[string]*url.URL)
+	for ip, u := range c.proxies {
+		if !failed[ip] {
+			l[ip] = u
+			continue
+		}
+		gone[ip] = u
+	}
+	// a new map so pools handed out by List() aren't changed under callers
+	c.proxies = l
+	kept = len(l)
+	c.proxiesMu.Unlock()
+	c.dropValidators(l)
+	c.removed(gone)
+	return kept, passes, ctx.Err()
+}
@@ -0,0 +1,47 @@
+package rsocks
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var errTLSIntercepted = errors.New("TLS intercepted")
+
+// SetCertFingerprints makes validation over an HTTPS check URL drop proxies
+// through which the endpoint doesn't present a certificate with one of the
+// SHA-256 fingerprints, given in hex with or without colons. Such proxies are
+// reported by TLSIntercepted. Proxies re-signing with a CA the system doesn't
+// trust already fail validation unless SetValidationTLSConfig skips
+// verification. No fingerprints disables the check.
+func (c *client) SetCertFingerprints(fingerprints ...string) {
+	pins := make(map[string]bool, len(fingerprints))
+	for _, fp := range fingerprints {
+		pins[strings.ToLower(strings.Replace(fp, ":", "", -1))] = true
+	}
+	c.certPins = pins
+}
+
+// TLSIntercepted reports whether validation dropped a proxy with the exit ip
+// for presenting an unexpected certificate.
+func (c *client) TLSIntercepted(ip string) bool {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	m, ok := c.metas[ip]
+	return ok && m.intercepted
+}
+
+// intercepted reports whether the check response r was served with a
+// certificate that isn't pinned.
+func (c *client) intercepted(r *http.Response) bool {
+	if len(c.certPins) == 0 || r.TLS == nil {
+		return false
+	}
+	if len(r.TLS.PeerCertificates) == 0 {
+		return true
+	}
+	sum := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+	return !c.certPins[hex.EncodeToString(sum[:])]
+}
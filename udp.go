@@ -0,0 +1,108 @@
+package rsocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"time"
+)
+
+// SupportsUDP asks the SOCKS5 proxy u for a UDP ASSOCIATE and reports
+// whether it granted it. The result is recorded for proxies of the pool, see
+// UDPProxies.
+func (c *client) SupportsUDP(ctx context.Context, u *url.URL) (bool, error) {
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return false, fmt.Errorf("%s isn't a SOCKS5 proxy", u.Host)
+	}
+	ctx, cancel := c.context(ctx)
+	defer cancel()
+	d := net.Dialer{Resolver: c.resolver}
+	conn, err := d.DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(60 * time.Second)
+	}
+	conn.SetDeadline(deadline)
+
+	granted, err := udpAssociate(conn, u.User)
+	if err != nil {
+		return false, err
+	}
+	c.proxiesMu.Lock()
+	s := u.String()
+	for ip, pu := range c.proxies {
+		if pu.String() == s {
+			c.meta(ip).udp = granted
+		}
+	}
+	c.proxiesMu.Unlock()
+	return granted, nil
+}
+
+// UDPProxies returns the proxies SupportsUDP found granting UDP ASSOCIATE.
+func (c *client) UDPProxies() []Proxy {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	var l []Proxy
+	for _, ip := range c.keys() {
+		if m, ok := c.metas[ip]; ok && m.udp {
+			l = append(l, c.record(ip, c.proxies[ip]))
+		}
+	}
+	return l
+}
+
+// udpAssociate runs the SOCKS5 handshake of RFC 1928 on conn, authenticating
+// with user if set, and sends a UDP ASSOCIATE.
+func udpAssociate(conn net.Conn, user *url.Userinfo) (bool, error) {
+	methods := []byte{0x00}
+	if user != nil {
+		methods = []byte{0x02}
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return false, err
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return false, err
+	}
+	if b[0] != 0x05 || b[1] != methods[0] {
+		return false, errors.New("SOCKS5 proxy refused the authentication method")
+	}
+	if user != nil {
+		pass, _ := user.Password()
+		req := []byte{0x01, byte(len(user.Username()))}
+		req = append(req, user.Username()...)
+		req = append(req, byte(len(pass)))
+		req = append(req, pass...)
+		if _, err := conn.Write(req); err != nil {
+			return false, err
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return false, err
+		}
+		if b[1] != 0x00 {
+			return false, errors.New("SOCKS5 proxy rejected the credentials")
+		}
+	}
+
+	// the client address is unknown yet, sent as 0.0.0.0:0
+	if _, err := conn.Write([]byte{0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0}); err != nil {
+		return false, err
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return false, err
+	}
+	if reply[0] != 0x05 {
+		return false, errors.New("invalid SOCKS5 reply")
+	}
+	return reply[1] == 0x00, nil
+}